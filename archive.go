@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const archiveTimeFormat = "20060102T150405.000000000Z"
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// writes pushed payload into archive directory of the resource,
+// keeping only the last archive_keep payloads
+//
+// The first line of archived payload is `# <method> <path>`
+// with the path and query of the push URL, the second one is
+// the time and outcome of the push, the third one is the
+// destination and tenant the payload was pushed to.
+//
+func (r *resource) archive(job *pushJob, now time.Time, outcome string) {
+	if r.archiveDir == "" {
+		return
+	}
+	if err := r.writeArchive(job, now, outcome); err != nil {
+		logger.Errorf("Failed to archive payload of resource %s - %s", r.name, err.Error())
+	}
+}
+
+func (r *resource) writeArchive(job *pushJob, now time.Time, outcome string) error {
+	pushURL, err := r.pushURL(job.dst, job.value)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(pushURL)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(r.archiveDir, 0755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s %s\n", job.method, u.RequestURI())
+	fmt.Fprintf(&buf, "# pushed at %s %s\n", now.UTC().Format(time.RFC3339Nano), outcome)
+	fmt.Fprintf(&buf, "# destination %s", job.dst)
+	if r.tenantID != "" {
+		fmt.Fprintf(&buf, " tenant %s", r.tenantID)
+	}
+	buf.WriteString("\n")
+	buf.Write(job.body)
+
+	name := now.UTC().Format(archiveTimeFormat) + "-" + unsafeFileChars.ReplaceAllString(job.dst, "_")
+	if job.value != "" {
+		name += "-" + unsafeFileChars.ReplaceAllString(job.value, "_")
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.archiveDir, name+".prom"), buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return pruneArchive(r.archiveDir, r.archiveKeep)
+}
+
+// removes all but the last keep payloads from archive directory
+//
+func pruneArchive(dir string, keep int) error {
+	files, err := listArchive(dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > keep {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// lists archived payloads in a directory from the oldest one
+//
+func listArchive(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Mode().IsRegular() && strings.HasSuffix(e.Name(), ".prom") {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
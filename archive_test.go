@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	r := newTestResource("", "http://localhost")
+	r.archiveDir = filepath.Join(dir, r.name)
+	r.archiveKeep = 3
+
+	start := time.Date(2019, 3, 1, 3, 12, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		r.archive(&pushJob{r: r, method: http.MethodPost, dst: "test1", body: []byte("test_value 1\n")},
+			start.Add(time.Duration(i)*time.Second), "status 202")
+	}
+
+	files, err := listArchive(r.archiveDir)
+	if err != nil {
+		t.Fatalf("Failed to list archive - %s", err.Error())
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 archived payloads, got %d", len(files))
+	}
+	if !strings.HasSuffix(files[0], "20190301T031202.000000000Z-test1.prom") {
+		t.Fatalf("Expected the oldest payloads to be removed, got %s", files[0])
+	}
+
+	data, _ := ioutil.ReadFile(files[2])
+	expect := "# POST /test1/metrics/job/resource1/instance/" + hostname + "\n# pushed at 2019-03-01T03:12:04Z status 202\n# destination test1\ntest_value 1\n"
+	if string(data) != expect {
+		t.Fatalf("Unexpected archived payload:\n%s", data)
+	}
+}
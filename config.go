@@ -4,92 +4,253 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pelletier/go-toml"
+	"github.com/prometheus/common/model"
 )
 
-// reads all config files into []byte
+var configParseWorkers = runtime.NumCPU()
+
+// loads config from a file or from all the config files
+// in a directory
+//
+// Files in a directory are parsed concurrently by a bounded
+// group of workers and merged in the order of their names.
+// Tables are merged across files, so e.g. `[res]` and
+// `[res.rename]` may be in different files, but the same option
+// can't be set in more than one file.
 //
-func concatConfigFiles(path string) ([]byte, error) {
-	var config []byte
+func loadConfig(path string) (*pusherConfig, error) {
+	start := time.Now()
 
-	pathCheck, err := os.Open(path)
+	pathInfo, err := os.Stat(path)
 	if err != nil {
-		return []byte{}, err
+		return nil, err
 	}
 
-	pathInfo, err := pathCheck.Stat()
-	if err != nil {
-		return []byte{}, err
+	files := []string{path}
+	if pathInfo.IsDir() {
+		if files, err = listConfigFiles(path); err != nil {
+			return nil, err
+		}
 	}
 
-	if pathInfo.IsDir() {
-		dir, _ := pathCheck.Readdir(-1)
-		buf := make([][]byte, len(dir))
-		for _, file := range dir {
-			if strings.HasSuffix(file.Name(), ".toml") && (file.Mode().IsRegular()) {
-				fileName := path + "/" + file.Name()
-				data, err2 := ioutil.ReadFile(fileName)
-				if err2 != nil {
-					logger.Errorf("Failed to read config file %s - %s", fileName, err2.Error())
-					continue
-				}
-				buf = append(buf, data)
+	trees := make([]*toml.Tree, len(files))
+	errs := make([]error, len(files))
+	idx := make(chan int, len(files))
+	for i := range files {
+		idx <- i
+	}
+	close(idx)
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < configParseWorkers && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				trees[i], errs[i] = loadConfigFile(files[i], pathInfo.IsDir())
 			}
+		}()
+	}
+	wg.Wait()
+
+	t, _ := toml.TreeFromMap(map[string]interface{}{})
+	for i, ft := range trees {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%s - %s", files[i], errs[i].Error())
+		}
+		if ft == nil {
+			continue
+		}
+		if err := mergeTrees(t, ft, ""); err != nil {
+			return nil, fmt.Errorf("%s - %s", files[i], err.Error())
 		}
-		config = bytes.Join(buf, []byte("\n"))
-		return config, nil
 	}
 
-	config, err = ioutil.ReadFile(path)
+	p, err := parseConfigTree(t)
 	if err != nil {
-		return []byte{}, err
+		return nil, err
 	}
-	return config, nil
+
+	self.set("prometheus_pusher_config_parse_duration_seconds", time.Since(start).Seconds())
+	self.set("prometheus_pusher_config_files", float64(len(files)))
+	return p, nil
+}
+
+// lists TOML and YAML files in a directory sorted by name
+//
+func listConfigFiles(path string) ([]string, error) {
+	dir, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(dir))
+	for _, file := range dir {
+		name := file.Name()
+		isTOML := strings.HasSuffix(name, ".toml")
+		isYAML := strings.HasSuffix(name, ".yml") || strings.HasSuffix(name, ".yaml")
+		if (isTOML || isYAML) && file.Mode().IsRegular() {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	return files, nil
+}
+
+// reads and parses single config file
+//
+// Files of a directory which can't be read and Prometheus configs
+// which can't be converted are skipped.
+//
+func loadConfigFile(fileName string, inDir bool) (*toml.Tree, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if !inDir {
+			return nil, err
+		}
+		logger.Errorf("Failed to read config file %s - %s", fileName, err.Error())
+		return nil, nil
+	}
+	if !inDir {
+		return loadConfigTree(data)
+	}
+
+	if strings.HasSuffix(fileName, ".yml") || strings.HasSuffix(fileName, ".yaml") {
+		if data, err = convertScrapeConfigs(data); err != nil {
+			logger.Errorf("Failed to convert config file %s - %s", fileName, err.Error())
+			return nil, nil
+		}
+	}
+	return toml.LoadBytes(data)
+}
+
+// merges tables of src into dst, fails if both set the same
+// option
+//
+func mergeTrees(dst *toml.Tree, src *toml.Tree, prefix string) error {
+	for _, key := range src.Keys() {
+		sv := src.GetPath([]string{key})
+		dv := dst.GetPath([]string{key})
+		if dv == nil {
+			dst.SetPath([]string{key}, sv)
+			continue
+		}
+		dt, dok := dv.(*toml.Tree)
+		st, sok := sv.(*toml.Tree)
+		if !dok || !sok {
+			return fmt.Errorf("duplicate option '%s%s'", prefix, key)
+		}
+		if err := mergeTrees(dt, st, prefix+key+"."); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // resource config type
 //
 type resourceConfig struct {
-	pushGatewayURL string
-	defaultRoute   string
-	resURL         string
-	port           int
-	host           string
-	ssl            bool
-	path           string
-	routeMap       string
+	pushGatewayURL   string
+	defaultRoute     string
+	resURL           string
+	port             int
+	host             string
+	hosts            []string // hosts scraped by separate resources
+	ssl              bool
+	path             string
+	routeMap         string
+	pushInterval     time.Duration
+	scrapeInterval   time.Duration
+	scrapeRetries    int
+	scrapeRetryDelay time.Duration
+	tenantID         string
+	pushParams       map[string]string
+	appendMetrics    bool // append `/metrics` to path of pushgateway_url
+	onScrapeFailure  string
+	metricPrefix     string
+	rename           []*renameRule
+	dropSeries       []*selector
+	groupByLabel     string
+	synthesizeType   string
+	dropQuantiles    bool
+	keepBuckets      []float64
+	sshTunnel        *sshTunnel
+	maxSeries        int
+	maxSeriesAction  string
+	archiveDir       string
+	archiveKeep      int
 }
 
 // global pusher config type
 // it contains instances of resourceConfig
 //
 type pusherConfig struct {
-	envLabels      map[string]string
-	pushGatewayURL string
-	defaultRoute   string
-	pushInterval   time.Duration
-	routeMap       string
-	resources      map[string]*resourceConfig
+	envLabels       map[string]string
+	pushGatewayURL  string
+	defaultRoute    string
+	pushInterval    time.Duration
+	scrapeInterval  time.Duration // zero means the same as push interval
+	routeMap        string
+	tenantID        string
+	pushParams      map[string]string
+	appendMetrics   bool
+	onScrapeFailure string
+	netrcFile       string // empty means ~/.netrc
+	netrc           *netrc
+	hosts           map[string]string // static addresses of hosts
+	archiveDir      string
+	archiveKeep     int
+	resources       map[string]*resourceConfig
 }
 
 // parses []byte with TOML config data into pusherConfig
 // instance
 //
+// Prometheus config with scrape_configs is accepted as well
+// and converted into TOML first.
+//
 func parseConfig(data []byte) (*pusherConfig, error) {
-	p := &pusherConfig{
-		pushInterval: time.Duration(60) * time.Second,
-		resources:    make(map[string]*resourceConfig),
+	t, err := loadConfigTree(data)
+	if err != nil {
+		return nil, err
 	}
+	return parseConfigTree(t)
+}
 
+// loads TOML tree from config data, converting Prometheus
+// config if needed
+//
+func loadConfigTree(data []byte) (*toml.Tree, error) {
 	rd := bytes.NewReader(data)
 	t, err := toml.LoadReader(rd)
-	if err != nil {
+	if err == nil || !isScrapeConfig(data) {
+		return t, err
+	}
+	if data, err = convertScrapeConfigs(data); err != nil {
 		return nil, err
 	}
+	return toml.LoadBytes(data)
+}
+
+// parses TOML tree into pusherConfig instance
+//
+func parseConfigTree(t *toml.Tree) (*pusherConfig, error) {
+	p := &pusherConfig{
+		pushInterval:    time.Duration(60) * time.Second,
+		onScrapeFailure: scrapeFailureSkip,
+		archiveKeep:     10,
+		resources:       make(map[string]*resourceConfig),
+	}
+	var err error
 
 	envLabelLabels := make([]interface{}, 0)
 	envLabelsSet := false
@@ -123,6 +284,16 @@ func parseConfig(data []byte) (*pusherConfig, error) {
 
 	if t.Has("config.push_interval") {
 		p.pushInterval = time.Duration(t.Get("config.push_interval").(int64)) * time.Second
+		if p.pushInterval <= 0 {
+			return nil, fmt.Errorf("push_interval has to be positive")
+		}
+	}
+
+	if t.Has("config.scrape_interval") {
+		p.scrapeInterval = time.Duration(t.Get("config.scrape_interval").(int64)) * time.Second
+		if p.scrapeInterval <= 0 {
+			return nil, fmt.Errorf("scrape_interval has to be positive")
+		}
 	}
 
 	if t.Has("config.route_map") {
@@ -133,27 +304,94 @@ func parseConfig(data []byte) (*pusherConfig, error) {
 		p.defaultRoute = t.Get("config.default_route").(string)
 	}
 
+	if t.Has("config.tenant_id") {
+		p.tenantID = t.Get("config.tenant_id").(string)
+	}
+
+	if t.Has("config.pushgateway_params") {
+		if p.pushParams, err = stringTable(t, "config.pushgateway_params"); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.Has("config.append_metrics_path") {
+		p.appendMetrics = t.Get("config.append_metrics_path").(bool)
+	}
+
+	if t.Has("config.hosts") {
+		if p.hosts, err = stringTable(t, "config.hosts"); err != nil {
+			return nil, err
+		}
+		for host, addr := range p.hosts {
+			if net.ParseIP(addr) == nil {
+				return nil, fmt.Errorf("invalid IP address '%s' of host '%s'", addr, host)
+			}
+		}
+	}
+
+	if t.Has("config.archive_dir") {
+		p.archiveDir = t.Get("config.archive_dir").(string)
+	}
+
+	if t.Has("config.archive_keep") {
+		p.archiveKeep = int(t.Get("config.archive_keep").(int64))
+	}
+	if p.archiveKeep < 1 {
+		return nil, fmt.Errorf("archive_keep has to be positive")
+	}
+
+	if t.Has("config.on_scrape_failure") {
+		p.onScrapeFailure = t.Get("config.on_scrape_failure").(string)
+		if !isScrapeFailurePolicy(p.onScrapeFailure) {
+			return nil, fmt.Errorf("invalid on_scrape_failure '%s'", p.onScrapeFailure)
+		}
+	}
+
+	if t.Has("config.netrc_file") {
+		p.netrcFile = t.Get("config.netrc_file").(string)
+	}
+	// credentials are read from ~/.netrc unless configured otherwise,
+	// only explicitly configured file has to exist and be valid
+	netrcFile := p.netrcFile
+	if netrcFile == "" {
+		netrcFile = defaultNetrcFile()
+	}
+	if netrcFile != "" {
+		if p.netrc, err = loadNetrc(netrcFile, p.netrcFile != ""); err != nil {
+			return nil, fmt.Errorf("failed to read netrc file %s - %s", netrcFile, err.Error())
+		}
+	}
+
 	for _, resName := range t.Keys() {
 		if resName == "config" || resName == "default_env_labels" || resName == "service_env_labels" {
 			continue
 		}
 
 		res := &resourceConfig{
-			pushGatewayURL: p.pushGatewayURL,
-			defaultRoute:   p.defaultRoute,
-			resURL:         "",
-			host:           "localhost",
-			port:           0,
-			ssl:            false,
-			path:           "metrics",
-			routeMap:       p.routeMap,
+			pushGatewayURL:   p.pushGatewayURL,
+			defaultRoute:     p.defaultRoute,
+			resURL:           "",
+			host:             "localhost",
+			port:             0,
+			ssl:              false,
+			path:             "metrics",
+			routeMap:         p.routeMap,
+			pushInterval:     p.pushInterval,
+			scrapeInterval:   p.scrapeInterval,
+			tenantID:         p.tenantID,
+			pushParams:       p.pushParams,
+			appendMetrics:    p.appendMetrics,
+			onScrapeFailure:  p.onScrapeFailure,
+			maxSeriesAction:  seriesLimitFail,
+			scrapeRetryDelay: time.Second,
+			archiveDir:       p.archiveDir,
+			archiveKeep:      p.archiveKeep,
 		}
 
 		if t.Has(resName + ".port") {
 			res.port = int(t.Get(resName + ".port").(int64))
 		} else {
-			logger.Fatalf("missing port for resource '%s', exiting", resName)
-			continue
+			return nil, fmt.Errorf("missing port of resource '%s'", resName)
 		}
 
 		if t.Has(resName + ".pushgateway_url") {
@@ -168,6 +406,15 @@ func parseConfig(data []byte) (*pusherConfig, error) {
 			res.host = t.Get(resName + ".host").(string)
 		}
 
+		if t.Has(resName + ".hosts") {
+			if t.Has(resName + ".host") {
+				return nil, fmt.Errorf("resource '%s' can't have both host and hosts", resName)
+			}
+			if res.hosts, err = parseHosts(t, resName); err != nil {
+				return nil, err
+			}
+		}
+
 		if t.Has(resName + ".ssl") {
 			res.ssl = t.Get(resName + ".ssl").(bool)
 		}
@@ -177,20 +424,277 @@ func parseConfig(data []byte) (*pusherConfig, error) {
 			res.path = strings.TrimPrefix(res.path, "/")
 		}
 
-		if t.Has(resName + ".route_map") {
-			res.routeMap = t.Get(resName + ".path").(string)
+		if t.Has(resName + ".push_interval") {
+			res.pushInterval = time.Duration(t.Get(resName+".push_interval").(int64)) * time.Second
+			if res.pushInterval <= 0 {
+				return nil, fmt.Errorf("push_interval of resource '%s' has to be positive", resName)
+			}
 		}
-		var scheme string
-		if res.ssl {
-			scheme = "https"
-		} else {
-			scheme = "http"
+
+		if t.Has(resName + ".scrape_interval") {
+			res.scrapeInterval = time.Duration(t.Get(resName+".scrape_interval").(int64)) * time.Second
+			if res.scrapeInterval <= 0 {
+				return nil, fmt.Errorf("scrape_interval of resource '%s' has to be positive", resName)
+			}
+		}
+		if res.scrapeInterval == 0 {
+			res.scrapeInterval = res.pushInterval
 		}
 
-		res.resURL = fmt.Sprintf("%s://%s:%d/%s", scheme, res.host, res.port, res.path)
+		if t.Has(resName + ".scrape_retries") {
+			res.scrapeRetries = int(t.Get(resName + ".scrape_retries").(int64))
+		}
+		if res.scrapeRetries < 0 {
+			return nil, fmt.Errorf("scrape_retries of resource '%s' can't be negative", resName)
+		}
+
+		if t.Has(resName + ".scrape_retry_delay") {
+			res.scrapeRetryDelay = time.Duration(t.Get(resName+".scrape_retry_delay").(int64)) * time.Second
+		}
+		if res.scrapeRetryDelay < 0 {
+			return nil, fmt.Errorf("scrape_retry_delay of resource '%s' can't be negative", resName)
+		}
+
+		if t.Has(resName + ".tenant_id") {
+			res.tenantID = t.Get(resName + ".tenant_id").(string)
+		}
+
+		if t.Has(resName + ".pushgateway_params") {
+			params, err := stringTable(t, resName+".pushgateway_params")
+			if err != nil {
+				return nil, err
+			}
+			// resource params are merged over the global ones
+			res.pushParams = make(map[string]string)
+			for k, v := range p.pushParams {
+				res.pushParams[k] = v
+			}
+			for k, v := range params {
+				res.pushParams[k] = v
+			}
+		}
+
+		if t.Has(resName + ".append_metrics_path") {
+			res.appendMetrics = t.Get(resName + ".append_metrics_path").(bool)
+		}
+
+		if t.Has(resName + ".on_scrape_failure") {
+			res.onScrapeFailure = t.Get(resName + ".on_scrape_failure").(string)
+			if !isScrapeFailurePolicy(res.onScrapeFailure) {
+				return nil, fmt.Errorf("invalid on_scrape_failure '%s' of resource '%s'", res.onScrapeFailure, resName)
+			}
+		}
+
+		if t.Has(resName + ".metric_prefix") {
+			res.metricPrefix = t.Get(resName + ".metric_prefix").(string)
+			if res.metricPrefix != "" && !model.IsValidMetricName(model.LabelValue(res.metricPrefix)) {
+				return nil, fmt.Errorf("invalid metric_prefix '%s' of resource '%s'", res.metricPrefix, resName)
+			}
+		}
+
+		if t.Has(resName + ".rename") {
+			table, ok := t.Get(resName + ".rename").(*toml.Tree)
+			if !ok {
+				return nil, fmt.Errorf("rename of resource '%s' has to be a table", resName)
+			}
+			if res.rename, err = newRenameRules(table.ToMap()); err != nil {
+				return nil, fmt.Errorf("resource '%s' - %s", resName, err.Error())
+			}
+		}
+
+		if t.Has(resName + ".drop_series") {
+			for _, raw := range t.Get(resName + ".drop_series").([]interface{}) {
+				sel, err := newSelector(raw.(string))
+				if err != nil {
+					return nil, fmt.Errorf("resource '%s' - %s", resName, err.Error())
+				}
+				res.dropSeries = append(res.dropSeries, sel)
+			}
+		}
+
+		if t.Has(resName + ".drop_quantiles") {
+			res.dropQuantiles = t.Get(resName + ".drop_quantiles").(bool)
+		}
+
+		if t.Has(resName + ".keep_buckets") {
+			for _, raw := range t.Get(resName + ".keep_buckets").([]interface{}) {
+				le, err := bucketBound(raw)
+				if err != nil {
+					return nil, fmt.Errorf("resource '%s' - %s", resName, err.Error())
+				}
+				res.keepBuckets = append(res.keepBuckets, le)
+			}
+		}
+
+		if t.Has(resName + ".synthesize_type") {
+			res.synthesizeType = t.Get(resName + ".synthesize_type").(string)
+			if res.synthesizeType != "untyped" && res.synthesizeType != "gauge" {
+				return nil, fmt.Errorf("invalid synthesize_type '%s' of resource '%s'", res.synthesizeType, resName)
+			}
+		}
+
+		if t.Has(resName + ".group_by_label") {
+			res.groupByLabel = t.Get(resName + ".group_by_label").(string)
+			if !model.LabelName(res.groupByLabel).IsValid() {
+				return nil, fmt.Errorf("invalid group_by_label '%s' of resource '%s'", res.groupByLabel, resName)
+			}
+		}
+
+		if t.Has(resName + ".max_series") {
+			res.maxSeries = int(t.Get(resName + ".max_series").(int64))
+		}
+
+		if t.Has(resName + ".max_series_action") {
+			res.maxSeriesAction = t.Get(resName + ".max_series_action").(string)
+			if res.maxSeriesAction != seriesLimitFail && res.maxSeriesAction != seriesLimitTruncate {
+				return nil, fmt.Errorf("invalid max_series_action '%s' of resource '%s'", res.maxSeriesAction, resName)
+			}
+		}
+
+		if t.Has(resName + ".archive_dir") {
+			res.archiveDir = t.Get(resName + ".archive_dir").(string)
+		}
+
+		if t.Has(resName + ".archive_keep") {
+			res.archiveKeep = int(t.Get(resName + ".archive_keep").(int64))
+		}
+		if res.archiveKeep < 1 {
+			return nil, fmt.Errorf("archive_keep of resource '%s' has to be positive", resName)
+		}
+
+		if t.Has(resName + ".ssh_jump_host") {
+			if res.sshTunnel, err = parseSSHTunnel(t, resName); err != nil {
+				return nil, err
+			}
+		}
+
+		if t.Has(resName + ".route_map") {
+			res.routeMap = t.Get(resName + ".route_map").(string)
+		}
+		res.resURL = res.hostURL(res.host)
 
 		p.resources[resName] = res
 	}
 
 	return p, nil
 }
+
+// URL of the resource on given host
+//
+func (rc *resourceConfig) hostURL(host string) string {
+	var scheme string
+	if rc.ssl {
+		scheme = "https"
+	} else {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s:%d/%s", scheme, host, rc.port, rc.path)
+}
+
+// lists hosts of the resource, single empty host stands for
+// resource without hosts option
+//
+func (rc *resourceConfig) hostList() []string {
+	if len(rc.hosts) == 0 {
+		return []string{""}
+	}
+	return rc.hosts
+}
+
+// checks whether the string is a known scrape failure policy
+//
+func isScrapeFailurePolicy(s string) bool {
+	switch s {
+	case scrapeFailureSkip, scrapeFailureUp, scrapeFailureZero, scrapeFailureDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// reads SSH tunnel options of a resource
+//
+func parseSSHTunnel(t *toml.Tree, resName string) (*sshTunnel, error) {
+	tun := &sshTunnel{
+		addr:       t.Get(resName + ".ssh_jump_host").(string),
+		knownHosts: defaultKnownHosts(),
+	}
+	if _, _, err := net.SplitHostPort(tun.addr); err != nil {
+		tun.addr = net.JoinHostPort(tun.addr, "22")
+	}
+	if !t.Has(resName+".ssh_user") || !t.Has(resName+".ssh_key") {
+		return nil, fmt.Errorf("ssh_user and ssh_key are mandatory with ssh_jump_host of resource '%s'", resName)
+	}
+	tun.user = t.Get(resName + ".ssh_user").(string)
+	tun.keyFile = t.Get(resName + ".ssh_key").(string)
+	if t.Has(resName + ".ssh_known_hosts") {
+		tun.knownHosts = t.Get(resName + ".ssh_known_hosts").(string)
+	}
+	return tun, nil
+}
+
+// reads hosts of the resource, which have to be a non-empty
+// array of unique strings
+//
+func parseHosts(t *toml.Tree, resName string) ([]string, error) {
+	list, ok := t.Get(resName + ".hosts").([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("hosts of resource '%s' has to be an array of strings", resName)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("hosts of resource '%s' can't be empty", resName)
+	}
+	hosts := make([]string, 0, len(list))
+	seen := make(map[string]bool)
+	for _, v := range list {
+		host, ok := v.(string)
+		if !ok || host == "" {
+			return nil, fmt.Errorf("hosts of resource '%s' has to be an array of strings", resName)
+		}
+		if seen[host] {
+			return nil, fmt.Errorf("duplicate host '%s' of resource '%s'", host, resName)
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// reads upper bound of histogram bucket, TOML doesn't allow
+// mixing integers and floats in an array, so strings are
+// accepted as well
+//
+func bucketBound(v interface{}) (float64, error) {
+	switch le := v.(type) {
+	case int64:
+		return float64(le), nil
+	case float64:
+		return le, nil
+	case string:
+		f, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid bucket bound '%s'", le)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("invalid bucket bound '%v'", v)
+	}
+}
+
+// reads table with string values
+//
+func stringTable(t *toml.Tree, key string) (map[string]string, error) {
+	table, ok := t.Get(key).(*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("%s has to be a table", key)
+	}
+	m := make(map[string]string)
+	for k, v := range table.ToMap() {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("value of %s in %s has to be a string", k, key)
+		}
+		m[k] = s
+	}
+	return m, nil
+}
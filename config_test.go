@@ -1,9 +1,110 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 func TestConfigParse(t *testing.T) {
 	if _, err := parseConfig(cfgTest); err != nil {
 		t.Fatalf("Failed to parse config - %s", err.Error())
 	}
 }
+
+func TestConfigErrors(t *testing.T) {
+	errorCases := map[string]string{
+		"missing port":                "[resource1]\nhost = \"localhost\"\n",
+		"global archive_keep":         "[config]\narchive_keep = 0\n",
+		"hosts not array":             "[resource1]\nhosts = \"db1\"\nport = 9100\n",
+		"hosts not strings":           "[resource1]\nhosts = [1]\nport = 9100\n",
+		"hosts empty":                 "[resource1]\nhosts = []\nport = 9100\n",
+		"negative scrape_retries":     "[resource1]\nport = 9100\nscrape_retries = -1\n",
+		"negative scrape_retry_delay": "[resource1]\nport = 9100\nscrape_retry_delay = -1\n",
+		"global push_interval":        "[config]\npush_interval = 0\n",
+		"global scrape_interval":      "[config]\nscrape_interval = -5\n",
+		"push_interval":               "[resource1]\nport = 9100\npush_interval = 0\n",
+		"scrape_interval":             "[resource1]\nport = 9100\nscrape_interval = -1\n",
+		"metric_prefix":               "[resource1]\nport = 9100\nmetric_prefix = \"acme-\"\n",
+		"hosts duplicate":             "[resource1]\nhosts = [\"db1\", \"db1\"]\nport = 9100\n",
+	}
+	for name, data := range errorCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseConfig([]byte(data)); err == nil {
+				t.Fatalf("Parsing of invalid config should fail")
+			}
+		})
+	}
+}
+
+func TestConfigParseScrapeConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("test/prometheus.yml")
+	if err != nil {
+		t.Fatalf("Failed to read Prometheus config - %s", err.Error())
+	}
+
+	c, err := parseConfig(data)
+	if err != nil {
+		t.Fatalf("Failed to parse Prometheus config - %s", err.Error())
+	}
+
+	checkConvertedResources(t, c)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher-conf.d")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"00-config.toml": "[config]\npushgateway_url = \"http://gw:9091/metrics\"\npush_interval = 30\n",
+		"ignored.txt":    "not a config",
+		"prometheus.yml": "scrape_configs:\n  - job_name: app\n    static_configs:\n      - targets: ['app:8080']\n",
+		// subtable of a resource defined in another file
+		"res01-rename.toml": "[res01.rename]\ngo_goroutines = \"goroutines\"\n",
+		// Prometheus config which can't be converted is skipped
+		"unsupported.yml": "scrape_configs:\n  - job_name: ftp\n    scheme: ftp\n    static_configs:\n      - targets: ['ftp:21']\n",
+	}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("res%02d.toml", i)] = fmt.Sprintf("[res%02d]\nport = %d\n", i, 9000+i)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write config file - %s", err.Error())
+		}
+	}
+
+	c, err := loadConfig(dir)
+	if err != nil {
+		t.Fatalf("Failed to load config - %s", err.Error())
+	}
+	if len(c.resources) != 51 {
+		t.Fatalf("Expected 51 resources, got %d", len(c.resources))
+	}
+	if c.resources["res07"].pushInterval != 30*time.Second || c.resources["res07"].pushGatewayURL != "http://gw:9091/metrics" {
+		t.Fatalf("Resources should inherit [config] section from another file")
+	}
+	if c.resources["app"] == nil {
+		t.Fatalf("Resource from Prometheus config is missing")
+	}
+	if len(c.resources["res01"].rename) != 1 || c.resources["res01"].port != 9001 {
+		t.Fatalf("Tables of a resource should be merged across files")
+	}
+	if !bytes.Contains(self.render(), []byte("prometheus_pusher_config_files 54\n")) {
+		t.Fatalf("Self metrics don't contain count of loaded files:\n%s", self.render())
+	}
+
+	dup := filepath.Join(dir, "zz-duplicate.toml")
+	if err := ioutil.WriteFile(dup, []byte("[res01]\nport = 1\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file - %s", err.Error())
+	}
+	if _, err := loadConfig(dir); err == nil {
+		t.Fatalf("Option repeated across files should be rejected")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// checks whether data is Prometheus config with scrape_configs
+//
+func isScrapeConfig(data []byte) bool {
+	var pc promConfig
+	if err := yaml.Unmarshal(data, &pc); err != nil {
+		return false
+	}
+	return len(pc.ScrapeConfigs) > 0
+}
+
+// subset of Prometheus configuration file relevant
+// for conversion into pusher config
+//
+type promConfig struct {
+	Global struct {
+		ScrapeInterval string `yaml:"scrape_interval"`
+	} `yaml:"global"`
+	ScrapeConfigs []promScrapeConfig `yaml:"scrape_configs"`
+}
+
+type promScrapeConfig struct {
+	JobName        string             `yaml:"job_name"`
+	ScrapeInterval string             `yaml:"scrape_interval"`
+	MetricsPath    string             `yaml:"metrics_path"`
+	Scheme         string             `yaml:"scheme"`
+	StaticConfigs  []promStaticConfig `yaml:"static_configs"`
+}
+
+type promStaticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+var invalidSectionChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// runs `convert` subcommand, prints TOML config converted
+// from given Prometheus config file to stdout
+//
+func runConvert(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one Prometheus config file, got %d arguments", len(args))
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	out, err := convertScrapeConfigs(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// converts static_configs of Prometheus scrape_configs into
+// pusher TOML config, one section per scraped target
+//
+// Scrape intervals are converted into per-resource scrape_interval
+// so the output doesn't contain `[config]` section and can be
+// merged with other config files.
+//
+func convertScrapeConfigs(data []byte) ([]byte, error) {
+	var pc promConfig
+	if err := yaml.Unmarshal(data, &pc); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# converted from Prometheus scrape_configs by prometheus-pusher\n")
+
+	seen := make(map[string]bool)
+	for _, sc := range pc.ScrapeConfigs {
+		if len(sc.StaticConfigs) == 0 {
+			logger.Warnf("Skipping job '%s' without static_configs", sc.JobName)
+			fmt.Fprintf(&buf, "\n# job '%s' skipped, only static_configs are supported\n", sc.JobName)
+			continue
+		}
+
+		scheme := sc.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("unsupported scheme '%s' in job '%s'", scheme, sc.JobName)
+		}
+
+		interval := sc.ScrapeInterval
+		if interval == "" {
+			interval = pc.Global.ScrapeInterval
+		}
+		var scrapeInterval int64
+		if interval != "" {
+			var err error
+			if scrapeInterval, err = parsePromDuration(interval); err != nil {
+				return nil, fmt.Errorf("invalid scrape_interval in job '%s' - %s", sc.JobName, err.Error())
+			}
+		}
+
+		path := sc.MetricsPath
+		if path == "" {
+			path = "/metrics"
+		}
+
+		targets := make([]string, 0)
+		labels := make(map[string]string)
+		for _, st := range sc.StaticConfigs {
+			targets = append(targets, st.Targets...)
+			for k, v := range st.Labels {
+				labels[k] = v
+			}
+		}
+
+		for _, target := range targets {
+			host, port, err := splitTarget(target, scheme)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target '%s' in job '%s' - %s", target, sc.JobName, err.Error())
+			}
+
+			name := sc.JobName
+			if len(targets) > 1 {
+				name = fmt.Sprintf("%s_%s_%d", sc.JobName, host, port)
+			}
+			name = invalidSectionChars.ReplaceAllString(name, "_")
+			if seen[name] {
+				return nil, fmt.Errorf("duplicate section name '%s' derived from job '%s'", name, sc.JobName)
+			}
+			seen[name] = true
+
+			fmt.Fprintf(&buf, "\n[%s]\n", name)
+			fmt.Fprintf(&buf, "host = %q\n", host)
+			fmt.Fprintf(&buf, "port = %d\n", port)
+			fmt.Fprintf(&buf, "path = %q\n", path)
+			fmt.Fprintf(&buf, "ssl = %t\n", scheme == "https")
+			if scrapeInterval != 0 {
+				fmt.Fprintf(&buf, "scrape_interval = %d\n", scrapeInterval)
+			}
+			for _, k := range sortedKeys(labels) {
+				fmt.Fprintf(&buf, "# label %s=%q is not supported and was skipped\n", k, labels[k])
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// parses Prometheus duration (e.g. `1m30s`) into seconds
+//
+func parsePromDuration(s string) (int64, error) {
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	secs := int64(time.Duration(d) / time.Second)
+	if secs < 1 {
+		return 0, fmt.Errorf("duration %s is shorter than one second", s)
+	}
+	return secs, nil
+}
+
+// splits Prometheus target into host and port, using the
+// scheme default port when none is given
+//
+func splitTarget(target string, scheme string) (string, int, error) {
+	if !strings.Contains(target, ":") || strings.HasSuffix(target, "]") {
+		if scheme == "https" {
+			return strings.Trim(target, "[]"), 443, nil
+		}
+		return strings.Trim(target, "[]"), 80, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
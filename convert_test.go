@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestConvert(t *testing.T) {
+	data, err := ioutil.ReadFile("test/prometheus.yml")
+	if err != nil {
+		t.Fatalf("Failed to read Prometheus config - %s", err.Error())
+	}
+
+	out, err := convertScrapeConfigs(data)
+	if err != nil {
+		t.Fatalf("Failed to convert Prometheus config - %s", err.Error())
+	}
+
+	c, err := parseConfig(out)
+	if err != nil {
+		t.Fatalf("Failed to parse converted config - %s\n%s", err.Error(), out)
+	}
+
+	checkConvertedResources(t, c)
+}
+
+func checkConvertedResources(t *testing.T, c *pusherConfig) {
+	resCases := map[string]struct {
+		url      string
+		interval time.Duration
+	}{
+		"node_db1_prod_9100": {"http://db1.prod:9100/metrics", 30 * time.Second},
+		"node_db2_prod_9100": {"http://db2.prod:9100/metrics", 30 * time.Second},
+		"app":                {"https://app.prod:443/internal/metrics", 15 * time.Second},
+	}
+	if len(c.resources) != len(resCases) {
+		t.Fatalf("Expected %d resources, got %d", len(resCases), len(c.resources))
+	}
+	for name, rc := range resCases {
+		res, ok := c.resources[name]
+		if !ok {
+			t.Fatalf("Missing resource '%s' in converted config", name)
+		}
+		if res.resURL != rc.url {
+			t.Fatalf("Resource '%s' expected to have URL %s, got %s", name, rc.url, res.resURL)
+		}
+		if res.scrapeInterval != rc.interval {
+			t.Fatalf("Resource '%s' expected to have scrape interval %s, got %s", name, rc.interval, res.scrapeInterval)
+		}
+		if res.pushInterval != 60*time.Second {
+			t.Fatalf("Resource '%s' expected to have default push interval, got %s", name, res.pushInterval)
+		}
+	}
+}
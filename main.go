@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"runtime"
 	"sync"
 	"syscall"
 	"time"
@@ -17,18 +18,26 @@ import (
 // global vars
 //
 var (
-	cfgPath           string
-	dummy             bool
-	verbose           uint
-	hostname          string
-	httpClientTimeout time.Duration
-	logger            *logrus.Entry
-	defaultConfPath   = "/etc/prometheus-pusher/conf.d"
-	defaultLogSocket  = "/run/showmax/socket_to_amqp.sock"
-	serviceName       = "prometheus-pusher"
-	version           string
-	versionFlag       bool
-	printMutex        = &sync.Mutex{}
+	cfgPath              string
+	stateFile            string
+	listenAddress        string
+	probe                bool
+	probeFormat          string
+	scrapeConcurrency    int
+	transformConcurrency int
+	pushConcurrency      int
+	queueSize            int
+	dummy                bool
+	verbose              uint
+	hostname             string
+	httpClientTimeout    time.Duration
+	logger               *logrus.Entry
+	defaultConfPath      = "/etc/prometheus-pusher/conf.d"
+	defaultLogSocket     = "/run/showmax/socket_to_amqp.sock"
+	serviceName          = "prometheus-pusher"
+	version              string
+	versionFlag          bool
+	printMutex           = &sync.Mutex{}
 )
 
 func init() {
@@ -36,11 +45,78 @@ func init() {
 	flag.StringVar(&cfgPath, "config", defaultConfPath,
 		"Config file or directory. If directory is specified then all "+
 			"files in the directory will be loaded.")
+	flag.StringVar(&stateFile, "state-file", "",
+		"File where runtime state of resources is saved on shutdown "+
+			"and loaded from on startup. Disabled when empty.")
+	flag.StringVar(&listenAddress, "listen-address", "",
+		"Address of internal listener exposing pusher's own metrics "+
+			"on /metrics and reloading config on POST /-/reload. Disabled when empty.")
+	flag.BoolVar(&probe, "probe", false,
+		"Probe connectivity of all targets and pushgateways without pushing, "+
+			"print report and exit. Exit status is 1 if any probe fails.")
+	flag.StringVar(&probeFormat, "probe-format", "table", "Format of probe report, table or json")
+	flag.IntVar(&scrapeConcurrency, "scrape-concurrency", 32, "Number of concurrent scrapes")
+	flag.IntVar(&transformConcurrency, "transform-concurrency", runtime.NumCPU(),
+		"Number of concurrent transformations of scraped metrics")
+	flag.IntVar(&pushConcurrency, "push-concurrency", 32, "Number of concurrent pushes")
+	flag.IntVar(&queueSize, "queue-size", 1024,
+		"Size of the queue of each pipeline stage, jobs not fitting into the queue are dropped")
 	flag.BoolVar(&dummy, "dummy", false,
 		"Do not post the metrics, just print them to stdout")
 	flag.UintVar(&verbose, "verbosity", 1, "Set logging verbosity.")
 	flag.DurationVar(&httpClientTimeout, "http-timeout", 30*time.Second, "Timeout for HTTP requests")
 	flag.BoolVar(&versionFlag, "version", false, "Print version and exit")
+	flag.Usage = usage
+
+	hostname = fqdn.Get()
+
+	// default logger, replaced in main() once verbosity is known
+	logger = newLogger(logrus.InfoLevel)
+}
+
+// prints usage including the list of subcommands
+//
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command [args]]\n\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  convert <prometheus.yml>\tConvert static scrape_configs into pusher TOML\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  replay [flags] <dir>\t\tPush payloads archived in directory into pushgateway\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  selftest\t\t\tRun scrape and push against in-process exporter and pushgateway\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  show-config\t\t\tPrint effective configuration loaded from -config\n\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "Flags:\n")
+	flag.PrintDefaults()
+}
+
+// creates logger instance with given log level
+//
+func newLogger(logLevel logrus.Level) *logrus.Entry {
+	_, l := sockrus.NewSockrus(sockrus.Config{
+		LogLevel:       logLevel,
+		Service:        serviceName,
+		SocketAddr:     defaultLogSocket,
+		SocketProtocol: "unix",
+	})
+	return l
+}
+
+// prepares global route map if there is any
+//
+func newGlobalRouteMap(cfg *pusherConfig) (*routeMap, error) {
+	if cfg.defaultRoute != "" && cfg.routeMap != "" {
+		return newRouteMap(cfg.routeMap, cfg.defaultRoute)
+	}
+	return nil, nil
+}
+
+// config reload requested via internal listener, done receives
+// the result of applying the config
+//
+type configReload struct {
+	cfg  *pusherConfig
+	done chan error
+}
+
+func main() {
 	flag.Parse()
 
 	if versionFlag {
@@ -58,51 +134,99 @@ func init() {
 	default:
 		logLevel = logrus.DebugLevel
 	}
+	logger = newLogger(logLevel)
 
-	hostname = fqdn.Get()
+	// run subcommand if there is any
+	switch flag.Arg(0) {
+	case "":
+	case "convert":
+		if err := runConvert(flag.Args()[1:]); err != nil {
+			logger.Fatalf("Failed to convert Prometheus config - %s", err.Error())
+		}
+		os.Exit(0)
+	case "replay":
+		if err := runReplay(flag.Args()[1:]); err != nil {
+			logger.Fatalf("Failed to replay payloads - %s", err.Error())
+		}
+		os.Exit(0)
+	case "selftest":
+		if err := runSelftest(os.Stdout); err != nil {
+			logger.Fatalf("Selftest failed - %s", err.Error())
+		}
+		os.Exit(0)
+	case "show-config":
+		if err := runShowConfig(cfgPath); err != nil {
+			logger.Fatalf("Failed to show config - %s", err.Error())
+		}
+		os.Exit(0)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	// create logger instance
-	_, logger = sockrus.NewSockrus(sockrus.Config{
-		LogLevel:       logLevel,
-		Service:        serviceName,
-		SocketAddr:     defaultLogSocket,
-		SocketProtocol: "unix",
-	})
-}
+	if probe {
+		ok, err := runProbe(cfgPath, probeFormat, os.Stdout)
+		if err != nil {
+			logger.Fatalf("Failed to probe - %s", err.Error())
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-func main() {
 	logger.Info("Starting prometheus-pusher")
 
-	// read config files
-	cfgData, err := concatConfigFiles(cfgPath)
-	if err != nil {
-		logger.Fatalf("Failed to read config files - %s", err.Error())
+	// configs reloaded via internal listener, applied by the main loop
+	reloads := make(chan *configReload)
+	if listenAddress != "" {
+		startWebListener(listenAddress, func() error {
+			cfg, err := loadConfig(cfgPath)
+			if err == nil {
+				rl := &configReload{cfg: cfg, done: make(chan error)}
+				reloads <- rl
+				err = <-rl.done
+			}
+			if err != nil {
+				logger.Errorf("Failed to reload config - %s", err.Error())
+				self.set("prometheus_pusher_config_last_reload_successful", 0)
+				return err
+			}
+			self.set("prometheus_pusher_config_last_reload_successful", 1)
+			return nil
+		})
 	}
 
-	// parse config data
-	pusherCfg, err := parseConfig(cfgData)
+	// read and parse config files
+	pusherCfg, err := loadConfig(cfgPath)
 	if err != nil {
-		logger.Fatalf("Failed to parse config data - %s", err.Error())
+		logger.Fatalf("Failed to load config - %s", err.Error())
 	}
+	self.set("prometheus_pusher_config_last_reload_successful", 1)
 
-	// prepare global route map if there is any
-	var globalRouteMap *routeMap
-	if pusherCfg.defaultRoute != "" && pusherCfg.routeMap != "" {
-		globalRouteMap = newRouteMap(pusherCfg.routeMap, pusherCfg.defaultRoute)
+	// spawn resources
+	grm, err := newGlobalRouteMap(pusherCfg)
+	if err != nil {
+		logger.Fatalf("Failed to load route map - %s", err.Error())
+	}
+	resources, err := createResources(pusherCfg, grm)
+	if err != nil {
+		logger.Fatalf("Failed to create resources - %s", err.Error())
 	}
 
-	// spawn resources
-	resources := createResources(pusherCfg, globalRouteMap)
+	// restore state saved by previous run
+	if stateFile != "" {
+		st, err := loadState(stateFile)
+		if err != nil {
+			logger.Errorf("Failed to load state file %s - %s", stateFile, err.Error())
+		} else {
+			resources.restoreState(st)
+		}
+	}
 
-	// handle signals for clean shutdown
+	// handle signals for clean shutdown, handled by the main loop
+	// so the shutdown doesn't race with reload
 	signal.Notify(resources.sig, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		for s := range resources.sig {
-			logger.Infof("Received %s signal, will shut down", s)
-			resources.shutdown()
-			return
-		}
-	}()
 
 	resources.process(pusherCfg)
 
@@ -110,8 +234,28 @@ func main() {
 		select {
 		case <-resources.run():
 			resources.process(pusherCfg)
+		case rl := <-reloads:
+			grm, err := newGlobalRouteMap(rl.cfg)
+			if err == nil {
+				err = resources.reload(rl.cfg, grm)
+			}
+			if err == nil {
+				pusherCfg = rl.cfg
+				logger.Info("Config reloaded")
+				resources.process(pusherCfg)
+			}
+			rl.done <- err
+		case s := <-resources.sig:
+			logger.Infof("Received %s signal, will shut down", s)
+			resources.shutdown()
 		case <-resources.stop():
+			resources.pipeline.stop()
 			logger.Info("Resources processing stopped")
+			if stateFile != "" {
+				if err := resources.state().save(stateFile); err != nil {
+					logger.Errorf("Failed to save state file %s - %s", stateFile, err.Error())
+				}
+			}
 			os.Exit(0)
 		}
 	}
@@ -74,7 +74,6 @@ func newMetric(m *metrics, idx int, rm *routeMap, ts *[]byte, cfg *pusherConfig)
 				dsts:  rm.route(m.bytes[m.dBrd[idx][0]:m.dBrd[idx][1]]),
 				bytes: bytes.Join(append(mf, *ts), []byte{' '}),
 			}
-			break
 		}
 		allSamples = append(allSamples, decSamples...)
 		// decSamples = decSamples[:0]
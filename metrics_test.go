@@ -11,7 +11,7 @@ import (
 func TestMetrics(t *testing.T) {
 	var m *metrics
 	var mapped map[string][]byte
-	rm := newRouteMap("test/routes", "test")
+	rm, _ := newRouteMap("test/routes", "test")
 	testRe := regexp.MustCompile(`^(?:\w+(?:{.*?})?)\s(?:-?\d+(?:\.\d+(?:e(\+|-)\d+)?)?)\s(?:\d{8,14})$`)
 	c, _ := parseConfig(cfgTest)
 
@@ -45,7 +45,7 @@ func TestMetrics(t *testing.T) {
 }
 
 func BenchmarkMetrics(b *testing.B) {
-	rm := newRouteMap("test/routes", "test")
+	rm, _ := newRouteMap("test/routes", "test")
 	c, _ := parseConfig(cfgTest)
 	for i := 0; i < b.N; i++ {
 		newMetrics(mbTest, c).imux(rm, c)
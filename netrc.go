@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// credentials of a single machine in netrc file
+//
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// credentials read from netrc file by machine name
+//
+type netrc struct {
+	machines map[string]*netrcEntry
+	def      *netrcEntry // credentials of `default` entry
+}
+
+// returns path of netrc file in the home directory
+//
+func defaultNetrcFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// reads netrc file, missing or invalid file results in no
+// credentials unless the file is required
+//
+func loadNetrc(path string, required bool) (*netrc, error) {
+	empty := &netrc{machines: make(map[string]*netrcEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return empty, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseNetrc(string(data))
+	if err != nil && !required {
+		logger.Warnf("Ignoring netrc file %s - %s", path, err.Error())
+		return empty, nil
+	}
+	return n, err
+}
+
+// token of netrc file with its line number
+//
+type netrcToken struct {
+	text string
+	line int
+}
+
+// parses netrc file content, `account` tokens are ignored and
+// `macdef` definitions are skipped
+//
+// Tokens are separated by any whitespace including newlines, so
+// e.g. value of `machine` may be on the next line.
+//
+func parseNetrc(data string) (*netrc, error) {
+	tokens := make([]netrcToken, 0)
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		for _, tok := range strings.Fields(lines[i]) {
+			if strings.HasPrefix(tok, "#") {
+				break
+			}
+			if tok == "macdef" {
+				// macro definition lasts until an empty line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				break
+			}
+			tokens = append(tokens, netrcToken{text: tok, line: i + 1})
+		}
+	}
+
+	n := &netrc{machines: make(map[string]*netrcEntry)}
+	var cur *netrcEntry
+	for j := 0; j < len(tokens); j++ {
+		tok := tokens[j]
+		if tok.text == "default" {
+			cur = &netrcEntry{}
+			n.def = cur
+			continue
+		}
+
+		if j+1 >= len(tokens) {
+			return nil, fmt.Errorf("netrc line %d - missing value of '%s'", tok.line, tok.text)
+		}
+		j++
+		val := tokens[j].text
+
+		switch tok.text {
+		case "machine":
+			cur = &netrcEntry{}
+			n.machines[val] = cur
+		case "login", "password", "account":
+			if cur == nil {
+				return nil, fmt.Errorf("netrc line %d - '%s' outside of machine", tok.line, tok.text)
+			}
+			if tok.text == "login" {
+				cur.login = val
+			} else if tok.text == "password" {
+				cur.password = val
+			}
+		default:
+			return nil, fmt.Errorf("netrc line %d - unknown token '%s'", tok.line, tok.text)
+		}
+	}
+	return n, nil
+}
+
+// sets basic auth of the request from netrc entry of its host,
+// credentials in the URL take precedence
+//
+func (n *netrc) authorize(req *http.Request) {
+	if n == nil || req.URL.User != nil {
+		return
+	}
+	e, ok := n.machines[req.URL.Hostname()]
+	if !ok {
+		e = n.def
+	}
+	if e != nil {
+		req.SetBasicAuth(e.login, e.password)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stages of the pipeline
+//
+const (
+	stageScrape    = "scrape"
+	stageTransform = "transform"
+	stagePush      = "push"
+)
+
+// resource to be scraped and/or pushed
+//
+type scrapeJob struct {
+	r        *resource
+	cfg      *pusherConfig
+	scrape   bool
+	push     bool
+	deadline time.Time // when the next scrape is due, zero means no limit
+}
+
+// metrics payload of a resource to be transformed and
+// inverse-multiplexed
+//
+type transformJob struct {
+	r    *resource
+	cfg  *pusherConfig
+	data []byte
+	zero bool // set values of all series to zero
+}
+
+// request into a single destination
+//
+type pushJob struct {
+	r      *resource
+	method string
+	dst    string
+	value  string // value of the grouping label
+	body   []byte
+}
+
+// channel-based pipeline where scraping, transformation
+// and pushing run as independent stages, each with its
+// own queue and workers
+//
+// Jobs which don't fit into a full queue are dropped, so
+// a slow stage doesn't stall the others.
+//
+type pipeline struct {
+	scrapeQ    chan *scrapeJob
+	transformQ chan *transformJob
+	pushQ      chan *pushJob
+	inflight   *sync.WaitGroup // jobs queued or being processed
+	workers    *sync.WaitGroup
+	stopping   chan struct{} // closed when the pipeline is being stopped
+}
+
+// creates pipeline and starts its workers
+//
+func newPipeline(scrapeWorkers int, transformWorkers int, pushWorkers int, queueSize int) *pipeline {
+	p := &pipeline{
+		scrapeQ:    make(chan *scrapeJob, queueSize),
+		transformQ: make(chan *transformJob, queueSize),
+		pushQ:      make(chan *pushJob, queueSize),
+		inflight:   &sync.WaitGroup{},
+		workers:    &sync.WaitGroup{},
+		stopping:   make(chan struct{}),
+	}
+
+	for i := 0; i < scrapeWorkers; i++ {
+		p.workers.Add(1)
+		go p.scrapeWorker()
+	}
+	for i := 0; i < transformWorkers; i++ {
+		p.workers.Add(1)
+		go p.transformWorker()
+	}
+	for i := 0; i < pushWorkers; i++ {
+		p.workers.Add(1)
+		go p.pushWorker()
+	}
+	return p
+}
+
+// waits until all queued jobs are processed
+//
+func (p *pipeline) wait() {
+	p.inflight.Wait()
+}
+
+// waits until all queued jobs are processed and stops the workers,
+// scrapes aren't retried while stopping
+//
+func (p *pipeline) stop() {
+	close(p.stopping)
+	p.inflight.Wait()
+	close(p.scrapeQ)
+	close(p.transformQ)
+	close(p.pushQ)
+	p.workers.Wait()
+}
+
+func (p *pipeline) enqueueScrape(job *scrapeJob) {
+	p.inflight.Add(1)
+	select {
+	case p.scrapeQ <- job:
+	default:
+		job.r.setQueued(false)
+		p.drop(stageScrape, job.r)
+	}
+	self.set("prometheus_pusher_queue_length", float64(len(p.scrapeQ)), "stage", stageScrape)
+}
+
+func (p *pipeline) enqueueTransform(job *transformJob) {
+	p.inflight.Add(1)
+	select {
+	case p.transformQ <- job:
+	default:
+		p.drop(stageTransform, job.r)
+	}
+	self.set("prometheus_pusher_queue_length", float64(len(p.transformQ)), "stage", stageTransform)
+}
+
+func (p *pipeline) enqueuePush(job *pushJob) {
+	p.inflight.Add(1)
+	select {
+	case p.pushQ <- job:
+	default:
+		p.drop(stagePush, job.r)
+	}
+	self.set("prometheus_pusher_queue_length", float64(len(p.pushQ)), "stage", stagePush)
+}
+
+// drops job which doesn't fit into a full queue
+//
+func (p *pipeline) drop(stage string, r *resource) {
+	logger.WithFields(logrus.Fields{
+		"resource_name": r.name,
+		"stage":         stage,
+	}).Warn("Queue is full, dropping job.")
+	self.add("prometheus_pusher_queue_dropped_total", 1, "stage", stage)
+	p.inflight.Done()
+}
+
+// scrapes resources and decides what is pushed
+//
+func (p *pipeline) scrapeWorker() {
+	defer p.workers.Done()
+	for job := range p.scrapeQ {
+		self.set("prometheus_pusher_queue_length", float64(len(p.scrapeQ)), "stage", stageScrape)
+		if job.scrape {
+			job.r.scrape(job.deadline, p.stopping)
+		}
+		if job.push {
+			tj, deletes := job.r.preparePush(job.cfg)
+			if tj != nil {
+				p.enqueueTransform(tj)
+			}
+			for _, pj := range deletes {
+				p.enqueuePush(pj)
+			}
+		}
+		job.r.setQueued(false)
+		p.inflight.Done()
+	}
+}
+
+// transforms and inverse-multiplexes metrics
+//
+func (p *pipeline) transformWorker() {
+	defer p.workers.Done()
+	for job := range p.transformQ {
+		self.set("prometheus_pusher_queue_length", float64(len(p.transformQ)), "stage", stageTransform)
+		for _, pj := range job.r.transformMetrics(job) {
+			p.enqueuePush(pj)
+		}
+		p.inflight.Done()
+	}
+}
+
+// sends metrics into their destinations
+//
+func (p *pipeline) pushWorker() {
+	defer p.workers.Done()
+	for job := range p.pushQ {
+		self.set("prometheus_pusher_queue_length", float64(len(p.pushQ)), "stage", stagePush)
+		job.r.push(job)
+		p.inflight.Done()
+	}
+}
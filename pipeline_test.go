@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("test_value 24\n"))
+	}))
+	defer exporter.Close()
+
+	release := make(chan struct{})
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gw.Close()
+
+	dummy = false
+	defer func() { dummy = true }()
+
+	c, _ := parseConfig(cfgTest)
+	p := newPipeline(1, 1, 1, 10)
+	defer p.stop()
+
+	slow := newTestResource(exporter.URL, gw.URL)
+	p.enqueueScrape(&scrapeJob{r: slow, cfg: c, scrape: true, push: true})
+
+	// push of the first resource blocks, scraping has to go on
+	other := newTestResource(exporter.URL, gw.URL)
+	p.enqueueScrape(&scrapeJob{r: other, cfg: c, scrape: true})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		other.mtx.Lock()
+		scraped := other.cache != nil
+		other.mtx.Unlock()
+		if scraped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Scraping is stalled by slow push")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	p.wait()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// kinds of probed endpoints
+//
+const (
+	probeTarget      = "target"
+	probePushgateway = "pushgateway"
+)
+
+// result of probing single endpoint, empty check means
+// the check was not run
+//
+type probeResult struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	DNS     string `json:"dns"`
+	Connect string `json:"connect"`
+	TLS     string `json:"tls,omitempty"`
+	HTTP    string `json:"http"`
+	Scrape  string `json:"scrape,omitempty"`
+	OK      bool   `json:"ok"`
+
+	client   *http.Client      // client making the HTTP request
+	netrc    *netrc            // credentials of the HTTP request
+	tunneled bool              // whether the target is reached through SSH tunnel
+	hosts    map[string]string // static host addresses
+}
+
+// runs connectivity probe of all targets and pushgateways
+// configured in given path and writes report in given format,
+// returns false if any of the probes failed
+//
+// Nothing is pushed, pushgateways are probed by getting their
+// `/metrics` endpoint.
+//
+func runProbe(path string, format string, w io.Writer) (bool, error) {
+	if format != "table" && format != "json" {
+		return false, fmt.Errorf("unknown probe format '%s'", format)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return false, err
+	}
+
+	results, err := probeAll(cfg)
+	if err != nil {
+		return false, err
+	}
+	ok := true
+	for _, res := range results {
+		ok = ok && res.OK
+		res.URL = redactURL(res.URL)
+	}
+
+	if format == "json" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return ok, err
+	}
+	return ok, writeProbeTable(w, results)
+}
+
+// probes all endpoints concurrently, results are sorted by kind,
+// name and URL
+//
+func probeAll(cfg *pusherConfig) ([]*probeResult, error) {
+	results := make([]*probeResult, 0)
+	seen := make(map[string]bool)
+	for name, rc := range cfg.resources {
+		for _, host := range rc.hostList() {
+			r, err := newResource(name, host, cfg, nil)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, &probeResult{Kind: probeTarget, Name: r.name, URL: r.resURL,
+				client: r.scrapeClient, netrc: r.netrc, tunneled: r.tunneled, hosts: cfg.hosts})
+			for _, u := range r.pushgatewayURLs() {
+				if seen[u] {
+					continue
+				}
+				seen[u] = true
+				results = append(results, &probeResult{Kind: probePushgateway, Name: r.name, URL: u,
+					client: &http.Client{Timeout: httpClientTimeout}, netrc: r.netrc})
+			}
+		}
+	}
+
+	sem := make(chan struct{}, scrapeConcurrency)
+	wg := &sync.WaitGroup{}
+	for _, res := range results {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(res *probeResult) {
+			defer wg.Done()
+			res.probe()
+			<-sem
+		}(res)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Kind != results[j].Kind {
+			return results[i].Kind > results[j].Kind
+		}
+		if results[i].Name != results[j].Name {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].URL < results[j].URL
+	})
+	return results, nil
+}
+
+// lists `/metrics` URLs of all pushgateways the resource may push
+// into, one for every destination of its route map
+//
+func (r *resource) pushgatewayURLs() []string {
+	dsts := make(map[string]bool)
+	if strings.Contains(r.pushGatewayURL, "%s") && r.routes != nil {
+		for _, dst := range r.routes.defaultRoute {
+			dsts[dst] = true
+		}
+		r.routes.Root().Walk(func(k []byte, v interface{}) bool {
+			rt, _ := v.([]string)
+			for _, dst := range rt {
+				dsts[dst] = true
+			}
+			return false
+		})
+	} else {
+		dsts[""] = true
+	}
+
+	urls := make([]string, 0, len(dsts))
+	for dst := range dsts {
+		pushURL, err := r.pushURL(dst, "")
+		if err != nil {
+			urls = append(urls, r.pushGatewayURL)
+			continue
+		}
+		// strip the grouping key, pushgateway serves its own
+		// metrics there
+		u, _ := url.Parse(pushURL)
+		u.Path = u.Path[:strings.LastIndex(u.Path, "/job/"+r.job)]
+		urls = append(urls, u.String())
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// runs the checks one by one, stops at the first failed one
+//
+// DNS, connect and TLS checks of resources scraped through SSH
+// tunnel are not run, as the target is resolved and connected
+// by the jump host. Targets with static address in `[config.hosts]`
+// aren't resolved.
+//
+func (res *probeResult) probe() {
+	if res.tunneled {
+		res.probeHTTP()
+		return
+	}
+
+	u, err := url.Parse(res.URL)
+	if err != nil {
+		res.DNS = err.Error()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpClientTimeout)
+	defer cancel()
+
+	host := u.Hostname()
+	if addr, ok := res.hosts[host]; ok {
+		host = addr
+		res.DNS = "ok " + addr + " (static)"
+	} else {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			res.DNS = err.Error()
+			return
+		}
+		res.DNS = "ok " + strings.Join(addrs, ",")
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		res.Connect = err.Error()
+		return
+	}
+	defer conn.Close()
+	res.Connect = "ok"
+
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if deadline, ok := ctx.Deadline(); ok {
+			tlsConn.SetDeadline(deadline)
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			res.TLS = err.Error()
+			return
+		}
+		res.TLS = "ok"
+	}
+
+	res.probeHTTP()
+}
+
+// checks HTTP status and, for resources, validity of the
+// scraped metrics, the request is authorized the same way
+// as scrapes and pushes
+//
+func (res *probeResult) probeHTTP() {
+	req, err := http.NewRequest(http.MethodGet, res.URL, nil)
+	if err != nil {
+		res.HTTP = err.Error()
+		return
+	}
+	res.netrc.authorize(req)
+
+	resp, err := res.client.Do(req)
+	if err != nil {
+		res.HTTP = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	res.HTTP = resp.Status
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		res.HTTP = err.Error()
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	if res.Kind == probeTarget {
+		var parser expfmt.TextParser
+		mfs, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+		if err != nil {
+			res.Scrape = err.Error()
+			return
+		}
+		series := 0
+		for _, mf := range mfs {
+			series += len(mf.Metric)
+		}
+		res.Scrape = fmt.Sprintf("ok %d metrics, %d series", len(mfs), series)
+	}
+	res.OK = true
+}
+
+// writes probe results as a table
+//
+func writeProbeTable(w io.Writer, results []*probeResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tURL\tDNS\tCONNECT\tTLS\tHTTP\tSCRAPE")
+	for _, res := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", res.Kind, res.Name,
+			res.URL, orDash(res.DNS), orDash(res.Connect),
+			orDash(res.TLS), orDash(res.HTTP), orDash(res.Scrape))
+	}
+	return tw.Flush()
+}
+
+// returns `-` for empty string
+//
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	// credentials come from netrc
+	authorized := func(w http.ResponseWriter, req *http.Request) bool {
+		if user, pass, _ := req.BasicAuth(); user != "pusher" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !authorized(w, req) {
+			return
+		}
+		if req.URL.Path != "/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("# TYPE test_value gauge\ntest_value 1\n"))
+	}))
+	defer exporter.Close()
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !authorized(w, req) {
+			return
+		}
+		if req.URL.Path != "/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gw.Close()
+
+	eu, _ := url.Parse(exporter.URL)
+	dir, err := ioutil.TempDir("", "probe")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	netrcFile := filepath.Join(dir, "netrc")
+	if err := ioutil.WriteFile(netrcFile, []byte("default login pusher password secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write netrc - %s", err.Error())
+	}
+	cfgFile := filepath.Join(dir, "pusher.toml")
+	cfg := fmt.Sprintf(`
+[config]
+pushgateway_url = "%s/metrics"
+route_map = "test/routes"
+netrc_file = "%s"
+
+[good]
+host = "%s"
+port = %s
+
+[broken]
+host = "%s"
+port = %s
+path = "/missing"
+`, gw.URL, netrcFile, eu.Hostname(), eu.Port(), eu.Hostname(), eu.Port())
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0644); err != nil {
+		t.Fatalf("Failed to write config - %s", err.Error())
+	}
+
+	var buf bytes.Buffer
+	ok, err := runProbe(cfgFile, "json", &buf)
+	if err != nil {
+		t.Fatalf("Failed to probe - %s", err.Error())
+	}
+	if ok {
+		t.Fatalf("Probe of broken resource should fail")
+	}
+
+	var results []*probeResult
+	if err := json.Unmarshal(buf.Bytes(), &results); err != nil {
+		t.Fatalf("Failed to parse probe report - %s\n%s", err.Error(), buf.String())
+	}
+	byName := make(map[string]*probeResult)
+	for _, res := range results {
+		if res.Kind == probeTarget {
+			byName[res.Name] = res
+		} else if !res.OK || res.URL != gw.URL+"/metrics" {
+			t.Fatalf("Unexpected pushgateway probe result %+v", res)
+		}
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected two targets and one pushgateway, got %d results", len(results))
+	}
+	if !byName["good"].OK || byName["good"].Scrape != "ok 1 metrics, 1 series" {
+		t.Fatalf("Unexpected probe result of good resource %+v", byName["good"])
+	}
+	if byName["broken"].OK || byName["broken"].Scrape != "" {
+		t.Fatalf("Unexpected probe result of broken resource %+v", byName["broken"])
+	}
+
+	if _, err := runProbe(cfgFile, "xml", &buf); err == nil {
+		t.Fatalf("Unknown probe format should be rejected")
+	}
+}
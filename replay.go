@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// how replayed sample timestamps are treated
+//
+const (
+	replayKeepTimestamps  = "keep"  // push the timestamps as archived
+	replayNowTimestamps   = "now"   // rewrite the timestamps to the time of replay
+	replayStripTimestamps = "strip" // remove the timestamps
+)
+
+// archived payload to be replayed
+//
+type replayPayload struct {
+	file   string
+	method string
+	path   string // path and query of the original push URL
+	dst    string // route destination the payload was pushed to
+	tenant string // X-Scope-OrgID the payload was pushed with
+	body   []byte
+}
+
+// runs `replay` subcommand, pushes payloads archived in given
+// directory into a pushgateway in the order they were pushed
+//
+// Payloads of multiple destinations can be replayed only when
+// the gateway URL includes `%s` replaced by the destination.
+//
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	gateway := fs.String("gateway", "", "Base URL of pushgateway the payloads are pushed into, %s is replaced by the destination (mandatory)")
+	netrcFile := fs.String("netrc", "", "Netrc file with credentials of the pushgateway (default ~/.netrc)")
+	timestamps := fs.String("timestamps", replayKeepTimestamps,
+		"What to do with sample timestamps, keep, now (rewrite to the time of replay) or strip")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] <archive directory>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *gateway == "" {
+		fs.Usage()
+		return fmt.Errorf("archive directory and -gateway are mandatory")
+	}
+	switch *timestamps {
+	case replayKeepTimestamps, replayNowTimestamps, replayStripTimestamps:
+	default:
+		return fmt.Errorf("unknown timestamps handling '%s'", *timestamps)
+	}
+
+	path := *netrcFile
+	if path == "" {
+		path = defaultNetrcFile()
+	}
+	var n *netrc
+	if path != "" {
+		var err error
+		if n, err = loadNetrc(path, *netrcFile != ""); err != nil {
+			return fmt.Errorf("failed to read netrc file %s - %s", path, err.Error())
+		}
+	}
+
+	files, err := listReplayFiles(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	payloads := make([]*replayPayload, 0, len(files))
+	dsts := make(map[string]bool)
+	for _, file := range files {
+		p, err := readReplayPayload(file)
+		if err != nil {
+			logger.Errorf("Failed to replay %s - %s", file, err.Error())
+			failed++
+			continue
+		}
+		payloads = append(payloads, p)
+		dsts[p.dst] = true
+	}
+	if len(dsts) > 1 && !strings.Contains(*gateway, "%s") {
+		return fmt.Errorf("payloads of %d destinations can't be replayed into single gateway, include %%s in -gateway", len(dsts))
+	}
+
+	client := &http.Client{Timeout: httpClientTimeout}
+	for _, p := range payloads {
+		err := p.rewriteTimestamps(*timestamps, time.Now())
+		if err == nil {
+			err = p.push(client, *gateway, n)
+		}
+		if err != nil {
+			logger.Errorf("Failed to replay %s - %s", p.file, err.Error())
+			failed++
+			continue
+		}
+		logger.Debugf("Replayed %s", p.file)
+	}
+
+	logger.Infof("Replayed %d of %d payloads", len(files)-failed, len(files))
+	if failed > 0 {
+		return fmt.Errorf("%d payloads failed to replay", failed)
+	}
+	return nil
+}
+
+// lists archived payloads in a directory and its subdirectories
+// sorted by the time they were pushed
+//
+func listReplayFiles(dir string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".prom") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// file names start with the time of the push
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	return files, nil
+}
+
+// reads archived payload, the header lines written by archive
+// are removed
+//
+// Payloads archived without destination line are replayed
+// without destination and tenant.
+//
+func readReplayPayload(file string) (*replayPayload, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := bufio.NewReader(bytes.NewReader(data))
+	header, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("missing header")
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[0] != "#" {
+		return nil, fmt.Errorf("invalid header '%s'", strings.TrimSpace(header))
+	}
+	p := &replayPayload{file: file, method: fields[1], path: fields[2]}
+
+	// time of the push
+	if _, err := rd.ReadString('\n'); err != nil {
+		return p, nil
+	}
+
+	if line, err := rd.Peek(len("# destination")); err == nil && string(line) == "# destination" {
+		header, _ := rd.ReadString('\n')
+		fields := strings.Fields(header)
+		if len(fields) > 2 {
+			p.dst = fields[2]
+		}
+		if len(fields) > 4 && fields[3] == "tenant" {
+			p.tenant = fields[4]
+		}
+	}
+	p.body, err = ioutil.ReadAll(rd)
+	return p, err
+}
+
+// rewrites or strips sample timestamps of the payload
+//
+func (p *replayPayload) rewriteTimestamps(mode string, now time.Time) error {
+	if mode == replayKeepTimestamps || len(p.body) == 0 {
+		return nil
+	}
+
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(bytes.NewReader(p.body))
+	if err != nil {
+		return err
+	}
+
+	ts := now.UnixNano() / int64(time.Millisecond)
+	names := make([]string, 0, len(mfs))
+	for name, mf := range mfs {
+		names = append(names, name)
+		for _, m := range mf.Metric {
+			if mode == replayNowTimestamps {
+				m.TimestampMs = &ts
+			} else {
+				m.TimestampMs = nil
+			}
+		}
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		if _, err := expfmt.MetricFamilyToText(&buf, mfs[name]); err != nil {
+			return err
+		}
+	}
+	p.body = buf.Bytes()
+	return nil
+}
+
+// pushes the payload into a pushgateway, `%s` of the gateway URL
+// is replaced by the destination and the part of the original
+// path starting with `/metrics/job/` is appended to its path
+//
+// The payload is pushed with the archived tenant and credentials
+// of the gateway from netrc.
+//
+func (p *replayPayload) push(client *http.Client, gateway string, n *netrc) error {
+	base, err := url.Parse(strings.Replace(gateway, "%s", p.dst, 1))
+	if err != nil {
+		return err
+	}
+	orig, err := url.Parse(p.path)
+	if err != nil {
+		return err
+	}
+	idx := strings.Index(orig.Path, "/metrics/job/")
+	if idx < 0 {
+		return fmt.Errorf("path '%s' isn't pushgateway push path", orig.Path)
+	}
+
+	u := *base
+	u.Path = strings.TrimRight(base.Path, "/") + orig.Path[idx:]
+	u.RawPath = ""
+	u.RawQuery = orig.RawQuery
+
+	if dummy {
+		printMutex.Lock()
+		defer printMutex.Unlock()
+		fmt.Printf("%s %s\n%s\n", p.method, u.String(), string(p.body))
+		return nil
+	}
+
+	req, err := http.NewRequest(p.method, u.String(), bytes.NewReader(p.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	n.authorize(req)
+	if p.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", p.tenant)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d - %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	r := newTestResource("", "http://old-gateway")
+	r.archiveDir = filepath.Join(dir, r.name)
+	r.archiveKeep = 10
+	r.tenantID = "acme"
+	start := time.Date(2019, 3, 1, 3, 12, 0, 0, time.UTC)
+	r.archive(&pushJob{r: r, method: http.MethodPost, dst: "test1", body: []byte("test_value 1 1551410000000\n")}, start, "failed")
+	r.archive(&pushJob{r: r, method: http.MethodPost, dst: "test2", body: []byte("test_value 2 1551410060000\n")}, start.Add(time.Minute), "failed")
+
+	var mtx sync.Mutex
+	requests := make([]string, 0)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		user, _, _ := req.BasicAuth()
+		requests = append(requests, req.Method+" "+req.URL.Path+" "+req.Header.Get("X-Scope-OrgID")+" "+user+"\n"+string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gw.Close()
+
+	netrcFile := filepath.Join(dir, "netrc")
+	u, _ := url.Parse(gw.URL)
+	ioutil.WriteFile(netrcFile, []byte("machine "+u.Hostname()+" login pusher password secret\n"), 0600)
+
+	dummy = false
+	defer func() { dummy = true }()
+
+	if err := runReplay([]string{"-gateway", gw.URL, dir}); err == nil {
+		t.Fatalf("Replay of multiple destinations into single gateway should be rejected")
+	}
+
+	if err := runReplay([]string{"-gateway", gw.URL + "/pgw/%s/", "-netrc", netrcFile, "-timestamps", "strip", dir}); err != nil {
+		t.Fatalf("Failed to replay - %s", err.Error())
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	path := "/metrics/job/resource1/instance/" + hostname + " acme pusher\n"
+	typ := "# TYPE test_value untyped\n"
+	if len(requests) != 2 || requests[0] != "POST /pgw/test1"+path+typ+"test_value 1\n" || requests[1] != "POST /pgw/test2"+path+typ+"test_value 2\n" {
+		t.Fatalf("Unexpected replayed requests %q", requests)
+	}
+
+	if err := runReplay([]string{dir}); err == nil {
+		t.Fatalf("Replay without gateway should be rejected")
+	}
+}
+
+func TestReplayTimestamps(t *testing.T) {
+	now := time.Date(2019, 3, 1, 3, 12, 0, 0, time.UTC)
+	timestampCases := []struct {
+		mode   string
+		expect string
+	}{
+		{replayKeepTimestamps, "test_value 1 1551410000000\n"},
+		{replayNowTimestamps, "# TYPE test_value untyped\ntest_value 1 1551409920000\n"},
+		{replayStripTimestamps, "# TYPE test_value untyped\ntest_value 1\n"},
+	}
+	for _, c := range timestampCases {
+		p := &replayPayload{body: []byte("test_value 1 1551410000000\n")}
+		if err := p.rewriteTimestamps(c.mode, now); err != nil {
+			t.Fatalf("Failed to rewrite timestamps - %s", err.Error())
+		}
+		if string(p.body) != c.expect {
+			t.Fatalf("Timestamps `%s` expected to result in %q, got %q", c.mode, c.expect, p.body)
+		}
+	}
+}
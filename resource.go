@@ -2,10 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,35 +20,112 @@ import (
 )
 
 type resources struct {
-	wg     *sync.WaitGroup
-	ticker *time.Ticker
-	sig    chan os.Signal
-	exit   chan struct{}
-	rs     map[string]*resource
+	pipeline *pipeline
+	tick     time.Duration
+	ticker   *time.Ticker
+	sig      chan os.Signal
+	exit     chan struct{}
+	rs       map[string]*resource
 }
 
-func createResources(cfg *pusherConfig, grm *routeMap) *resources {
+// creates resources of all the configured hosts, fails if any
+// of them can't be created
+//
+func createResources(cfg *pusherConfig, grm *routeMap) (*resources, error) {
 	rs := make(map[string]*resource)
 
-	for name := range cfg.resources {
-		rs[name] = newResource(name, cfg, grm)
+	// tick by the greatest common divisor of all the intervals,
+	// so each resource is due exactly at multiples of its own
+	// intervals
+	var tick time.Duration
+	for name, rc := range cfg.resources {
+		for _, host := range rc.hostList() {
+			r, err := newResource(name, host, cfg, grm)
+			if err != nil {
+				return nil, err
+			}
+			rs[r.name] = r
+			tick = gcd(tick, r.pushInterval)
+			tick = gcd(tick, r.scrapeInterval)
+		}
+	}
+	if tick == 0 {
+		tick = cfg.pushInterval
 	}
 
 	return &resources{
 		rs:     rs,
-		ticker: time.NewTicker(cfg.pushInterval),
+		tick:   tick,
+		ticker: time.NewTicker(tick),
 		sig:    make(chan os.Signal, 1),
 		exit:   make(chan struct{}, 1),
-		wg:     &sync.WaitGroup{},
+		pipeline: newPipeline(scrapeConcurrency, transformConcurrency,
+			pushConcurrency, queueSize),
+	}, nil
+}
+
+// replaces resources by the ones created from new config, the
+// current resources are kept if the new ones can't be created
+//
+// Jobs queued by the old resources are finished first, runtime
+// state and deferred pushes of resources kept in the new config
+// are carried over.
+//
+func (rs *resources) reload(cfg *pusherConfig, grm *routeMap) error {
+	nrs, err := createResources(cfg, grm)
+	if err != nil {
+		return err
+	}
+
+	rs.pipeline.stop()
+	rs.ticker.Stop()
+	nrs.restoreState(rs.state())
+	for name, r := range nrs.rs {
+		if old, ok := rs.rs[name]; ok {
+			r.carryDeferred(old)
+		}
 	}
+	rs.rs = nrs.rs
+	rs.tick = nrs.tick
+	rs.ticker = nrs.ticker
+	rs.pipeline = nrs.pipeline
+	return nil
 }
 
+// queues all due resources into the pipeline, resources
+// still queued since the previous tick are skipped
+//
+// Deferred pushes whose back off elapsed are queued as well.
+//
 func (rs *resources) process(cfg *pusherConfig) {
+	now := time.Now()
 	for _, r := range rs.rs {
-		rs.wg.Add(1)
-		go r.getAndPush(rs.wg, cfg)
+		for _, job := range r.retries(now) {
+			rs.pipeline.enqueuePush(job)
+		}
+
+		scrape := isDue(r.lastScrape, r.scrapeInterval, now, rs.tick)
+		push := isDue(r.lastPush, r.pushInterval, now, rs.tick)
+		if !scrape && !push {
+			continue
+		}
+		if !r.setQueued(true) {
+			logger.WithFields(logrus.Fields{
+				"resource_name": r.name,
+			}).Warn("Resource is still queued since previous tick, skipping.")
+			continue
+		}
+		job := &scrapeJob{r: r, cfg: cfg, scrape: scrape, push: push}
+		if scrape {
+			r.lastScrape = now
+			// retries have to finish before the next scrape is due
+			job.deadline = r.lastScrape.Add(r.scrapeInterval)
+		}
+		if push {
+			r.lastPush = now
+		}
+		rs.pipeline.enqueueScrape(job)
 	}
-	rs.wg.Wait()
 }
 
 func (rs *resources) run() <-chan time.Time {
@@ -57,24 +141,95 @@ func (rs *resources) shutdown() {
 	rs.exit <- struct{}{}
 }
 
+// policies applied on push when the last scrape failed
+//
+const (
+	scrapeFailureSkip   = "skip"   // don't push anything
+	scrapeFailureUp     = "up"     // push only `up 0`
+	scrapeFailureZero   = "zero"   // push the last scraped series with zero values
+	scrapeFailureDelete = "delete" // delete the pushed groups from pushgateway
+)
+
+// group in a destination the resource pushed metrics into,
+// value of the grouping label is empty unless group_by_label
+// is set
+//
+type pushGroup struct {
+	dst   string
+	value string
+}
+
+// actions taken when scraped metrics exceed max_series
+//
+const (
+	seriesLimitFail     = "fail"     // don't push anything
+	seriesLimitTruncate = "truncate" // push only the first max_series series
+)
+
+// bounds of back off asked for by Retry-After header
+//
+const (
+	minRetryAfter = time.Second
+	maxRetryAfter = 10 * time.Minute
+)
+
+// push deferred until the destination allows it
+//
+type deferredPush struct {
+	until time.Time
+	job   *pushJob // the latest payload
+}
+
 type resource struct {
-	name           string
-	pushGatewayURL string
-	resURL         string
-	routes         *routeMap
-	httpClient     *http.Client
+	name             string
+	job              string // job of the pushed group
+	instance         string // instance of the pushed group
+	pushGatewayURL   string
+	resURL           string
+	pushInterval     time.Duration
+	scrapeInterval   time.Duration
+	scrapeRetries    int
+	scrapeRetryDelay time.Duration
+	tenantID         string
+	pushParams       map[string]string
+	appendMetrics    bool // append `/metrics` to path of pushgateway URL
+	lastScrape       time.Time
+	lastPush         time.Time
+	mtx              *sync.Mutex // guards the fields below
+	queued           bool        // whether the resource is in the scrape stage
+	cache            []byte      // last successfully scraped metrics
+	scrapeFailed     bool        // whether the last scrape failed
+	failures         int         // count of consecutive failed scrapes
+	onFailure        string
+	groupByLabel     string             // label partitioning metrics into groups
+	pushedDsts       map[pushGroup]bool // groups of the last push
+	deferred         map[pushGroup]*deferredPush
+	netrc            *netrc
+	transform        *transform
+	maxSeries        int    // limit of pushed series, unlimited when zero
+	archiveDir       string // directory of archived payloads, disabled when empty
+	archiveKeep      int    // number of archived payloads kept
+	seriesAction     string // what to do when the limit is exceeded
+	routes           *routeMap
+	httpClient       *http.Client // client pushing metrics
+	scrapeClient     *http.Client // client scraping the resource
+	tunneled         bool         // whether the resource is scraped through SSH tunnel
 }
 
 // creates new instance of resource
 //
-func newResource(name string, cfg *pusherConfig, grm *routeMap) *resource {
+// Resources of sections with multiple hosts are created for each
+// of the hosts, named `<section>@<host>` and pushed with the host
+// as instance, otherwise host is empty.
+//
+func newResource(name string, host string, cfg *pusherConfig, grm *routeMap) (*resource, error) {
 	var pushgatewayURL string
 	if cfg.resources[name].pushGatewayURL != "" {
 		pushgatewayURL = cfg.resources[name].pushGatewayURL
 	} else if cfg.pushGatewayURL != "" {
 		pushgatewayURL = cfg.pushGatewayURL
 	} else {
-		logger.Fatalf("No pushgateway_url derived from config for resource '%s'", name)
+		return nil, fmt.Errorf("no pushgateway_url derived from config for resource '%s'", name)
 	}
 
 	defaultRoute := cfg.defaultRoute
@@ -82,33 +237,139 @@ func newResource(name string, cfg *pusherConfig, grm *routeMap) *resource {
 		defaultRoute = cfg.resources[name].defaultRoute
 	}
 
-	var rm *routeMap
+	routeMapFile := cfg.routeMap
 	if cfg.resources[name].routeMap != "" {
-		rm = newRouteMap(cfg.resources[name].routeMap, defaultRoute)
-	} else {
-		rm = newRouteMap(cfg.routeMap, defaultRoute)
+		routeMapFile = cfg.resources[name].routeMap
+	}
+	rm, err := newRouteMap(routeMapFile, defaultRoute)
+	if err != nil {
+		return nil, fmt.Errorf("resource '%s' - %s", name, err.Error())
+	}
+
+	id, instance, resURL := name, hostname, cfg.resources[name].resURL
+	if host != "" {
+		id = name + "@" + host
+		instance = host
+		resURL = cfg.resources[name].hostURL(host)
+	}
+
+	// each resource archives into its own subdirectory
+	var archiveDir string
+	if cfg.resources[name].archiveDir != "" {
+		archiveDir = filepath.Join(cfg.resources[name].archiveDir, id)
 	}
 
 	return &resource{
-		name:           name,
-		pushGatewayURL: pushgatewayURL,
-		resURL:         cfg.resources[name].resURL,
-		routes:         rm,
+		name:             id,
+		job:              name,
+		instance:         instance,
+		pushGatewayURL:   pushgatewayURL,
+		resURL:           resURL,
+		pushInterval:     cfg.resources[name].pushInterval,
+		scrapeInterval:   cfg.resources[name].scrapeInterval,
+		scrapeRetries:    cfg.resources[name].scrapeRetries,
+		scrapeRetryDelay: cfg.resources[name].scrapeRetryDelay,
+		tenantID:         cfg.resources[name].tenantID,
+		pushParams:       cfg.resources[name].pushParams,
+		appendMetrics:    cfg.resources[name].appendMetrics,
+		onFailure:        cfg.resources[name].onScrapeFailure,
+		mtx:              &sync.Mutex{},
+		groupByLabel:     cfg.resources[name].groupByLabel,
+		pushedDsts:       make(map[pushGroup]bool),
+		deferred:         make(map[pushGroup]*deferredPush),
+		netrc:            cfg.netrc,
+		transform:        newTransform(cfg.resources[name]),
+		maxSeries:        cfg.resources[name].maxSeries,
+		seriesAction:     cfg.resources[name].maxSeriesAction,
+		archiveDir:       archiveDir,
+		archiveKeep:      cfg.resources[name].archiveKeep,
+		routes:           rm,
 		httpClient: &http.Client{
 			Timeout: httpClientTimeout,
 		},
+		scrapeClient: newScrapeClient(cfg.resources[name], cfg.hosts),
+		tunneled:     cfg.resources[name].sshTunnel != nil,
+	}, nil
+}
+
+// creates client scraping the resource, either directly or
+// through SSH tunnel, hosts with static address aren't resolved
+//
+func newScrapeClient(rc *resourceConfig, hosts map[string]string) *http.Client {
+	client := &http.Client{
+		Timeout: httpClientTimeout,
+	}
+	if rc.sshTunnel == nil && len(hosts) == 0 {
+		return client
 	}
+
+	var transport *http.Transport
+	if rc.sshTunnel != nil {
+		transport = rc.sshTunnel.transport()
+	} else {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	if len(hosts) > 0 {
+		transport.DialContext = overrideHosts(hosts, transport.DialContext)
+	}
+	client.Transport = transport
+	return client
+}
+
+// wraps dial function, so hosts with static address are
+// connected without resolving them
+//
+func overrideHosts(hosts map[string]string, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if ip, ok := hosts[host]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// greatest common divisor of two durations
+//
+func gcd(a time.Duration, b time.Duration) time.Duration {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// checks whether action last run at given time with given
+// interval should run in the tick starting at now, half of
+// the tick is tolerated as ticker jitter
+//
+func isDue(last time.Time, interval time.Duration, now time.Time, tick time.Duration) bool {
+	if last.IsZero() {
+		return true
+	}
+	return now.Sub(last) >= interval-tick/2
 }
 
 // retrieve metrics of a resource
 //
-func (r *resource) getMetrics() []byte {
+func (r *resource) getMetrics(ctx context.Context) []byte {
 	logger.WithFields(logrus.Fields{
 		"resource_name": r.name,
 		"resource_url":  r.resURL,
 	}).Debug("Getting metrics")
 
-	resp, err := r.httpClient.Get(r.resURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.resURL, nil)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error":         err.Error(),
+			"resource_name": r.name,
+			"resource_url":  r.resURL,
+		}).Error("Failed to create scrape request.")
+		return nil
+	}
+	r.netrc.authorize(req)
+
+	resp, err := r.scrapeClient.Do(req)
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"error":         err.Error(),
@@ -142,32 +403,107 @@ func (r *resource) getMetrics() []byte {
 	return body
 }
 
-// push metrics into given destination
+// builds URL of the resource's group in given destination
 //
-func (r *resource) pushMetrics(metrics []byte, dst string, wg *sync.WaitGroup) {
-	defer wg.Done()
+// Path of the pushgateway URL is kept as a prefix, so pushgateway
+// can run behind a reverse proxy, with append_metrics_path
+// `/metrics` is appended unless the path already ends with it.
+// Query parameters of the URL are kept and pushgateway_params are
+// added to them.
+//
+// Non-empty value of the grouping label is added to the grouping
+// key, values containing `/` are base64 encoded as pushgateway
+// expects.
+//
+func (r *resource) pushURL(dst string, value string) (string, error) {
+	base := r.pushGatewayURL
+	if strings.Contains(base, "%s") {
+		base = fmt.Sprintf(base, dst)
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	p := strings.TrimRight(u.Path, "/")
+	if r.appendMetrics && !strings.HasSuffix(p, "/metrics") {
+		p += "/metrics"
+	}
+	p += "/job/" + r.job + "/instance/" + r.instance
+	if r.groupByLabel != "" && value != "" {
+		if strings.Contains(value, "/") {
+			p += "/" + r.groupByLabel + "@base64/" + base64.URLEncoding.EncodeToString([]byte(value))
+		} else {
+			p += "/" + r.groupByLabel + "/" + value
+		}
+	}
+	u.Path = p
+	u.RawPath = ""
+
+	if len(r.pushParams) > 0 {
+		q := u.Query()
+		for k, v := range r.pushParams {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	return u.String(), nil
+}
+
+// sends request with metrics into given destination, returns
+// how long to back off if the destination asks for it by
+// Retry-After header of 429 or 503 response and the outcome
+// of the push recorded in the archive
+//
+func (r *resource) send(method string, metrics []byte, dst string, value string) (time.Duration, string) {
+	postURL, err := r.pushURL(dst, value)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error":           err.Error(),
+			"pushgateway_url": r.pushGatewayURL,
+			"resource_name":   r.name,
+		}).Error("Failed to build push URL.")
+		return 0, "failed"
+	}
 
-	postURL := fmt.Sprintf(r.pushGatewayURL, dst) + fmt.Sprintf("/job/%s/instance/%s", r.name, hostname)
 	if dummy {
 		printMutex.Lock()
 		defer printMutex.Unlock()
-		fmt.Printf("POST %s\n%s\n", postURL, string(metrics))
-		return
+		fmt.Printf("%s %s\n%s\n", method, postURL, string(metrics))
+		return 0, "printed"
 	}
 
 	logger.WithFields(logrus.Fields{
 		"endpoint_url":  postURL,
+		"method":        method,
 		"resource_name": r.name,
 	}).Debug("Pushing metrics.")
 
 	data := bytes.NewReader(metrics)
-	resp, err := r.httpClient.Post(postURL, "text/plain", data)
+	req, err := http.NewRequest(method, postURL, data)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"endpoint_url": postURL,
+			"error":        err.Error(),
+		}).Error("Failed to create push request.")
+		return 0, "failed"
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	r.netrc.authorize(req)
+	// multi-tenant backends like Cortex or Mimir pick the tenant by this header
+	if r.tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", r.tenantID)
+	}
+
+	resp, err := r.httpClient.Do(req)
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"endpoint_url": postURL,
 			"error":        err.Error(),
 		}).Error("Failed to push metrics.")
-		return
+		return 0, "failed"
 	}
 	defer resp.Body.Close()
 
@@ -180,6 +516,18 @@ func (r *resource) pushMetrics(metrics []byte, dst string, wg *sync.WaitGroup) {
 		}).Error("Failed to read response body while pushing metrics.")
 	}
 
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			logger.WithFields(logrus.Fields{
+				"endpoint_url":  postURL,
+				"retry_after":   wait.String(),
+				"status":        resp.StatusCode,
+				"resource_name": r.name,
+			}).Warn("Pushgateway asked to back off, deferring push.")
+			return wait, fmt.Sprintf("status %d", resp.StatusCode)
+		}
+	}
+
 	if resp.StatusCode != http.StatusAccepted {
 		logger.WithFields(logrus.Fields{
 			"body":          string(body),
@@ -188,20 +536,278 @@ func (r *resource) pushMetrics(metrics []byte, dst string, wg *sync.WaitGroup) {
 			"resource_url":  r.resURL,
 		}).Error("Got non-OK status code while pushing metrics.")
 	}
+	return 0, fmt.Sprintf("status %d", resp.StatusCode)
+}
+
+// parses Retry-After header, either delay in seconds or
+// HTTP date, the delay is kept between minRetryAfter and
+// maxRetryAfter
+//
+func parseRetryAfter(h string, now time.Time) (time.Duration, bool) {
+	if h == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		wait = time.Duration(secs) * time.Second
+		if secs > int(maxRetryAfter/time.Second) {
+			wait = maxRetryAfter
+		}
+	} else if t, err := http.ParseTime(h); err == nil {
+		wait = t.Sub(now)
+	} else {
+		return 0, false
+	}
+
+	if wait < minRetryAfter {
+		return minRetryAfter, true
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter, true
+	}
+	return wait, true
+}
+
+// pushes metrics unless the destination asked to back off
+//
+// While backing off, only the latest payload of each group
+// is kept and it's pushed once the destination allows it.
+// Payloads are archived once pushed, not while deferred.
+//
+func (r *resource) push(job *pushJob) {
+	g := pushGroup{dst: job.dst, value: job.value}
+	now := time.Now()
+
+	r.mtx.Lock()
+	if d, ok := r.deferred[g]; ok {
+		if now.Before(d.until) {
+			d.job = job
+			r.mtx.Unlock()
+			return
+		}
+		// newer payload supersedes the deferred one
+		delete(r.deferred, g)
+	}
+	r.mtx.Unlock()
+
+	wait, outcome := r.send(job.method, job.body, job.dst, job.value)
+	if wait == 0 {
+		r.archive(job, now, outcome)
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.deferred[g] = &deferredPush{until: now.Add(wait), job: job}
+}
+
+// returns deferred pushes which may be retried at given time
+//
+func (r *resource) retries(now time.Time) []*pushJob {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	jobs := make([]*pushJob, 0)
+	for g, d := range r.deferred {
+		if !now.Before(d.until) {
+			jobs = append(jobs, d.job)
+			delete(r.deferred, g)
+		}
+	}
+	return jobs
+}
+
+// takes over pushes deferred by the resource replaced
+// on reload
+//
+func (r *resource) carryDeferred(old *resource) {
+	old.mtx.Lock()
+	defer old.mtx.Unlock()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for g, d := range old.deferred {
+		job := *d.job
+		job.r = r
+		r.deferred[g] = &deferredPush{until: d.until, job: &job}
+	}
+}
+
+// marks resource as queued in the scrape stage or not, returns
+// false if the resource is already in requested state
+//
+func (r *resource) setQueued(queued bool) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.queued == queued {
+		return false
+	}
+	r.queued = queued
+	return true
+}
+
+// gets metrics and caches them, so they can be pushed in the
+// cycles when the resource isn't scraped
+//
+// Failed scrape is retried up to scrape_retries times. The first
+// attempt is limited only by the HTTP client timeout, retries
+// have to finish by deadline, when the next scrape is due, zero
+// deadline means no limit. Retries are given up once stop is
+// closed.
+//
+func (r *resource) scrape(deadline time.Time, stop <-chan struct{}) {
+	metricsBytes := r.getMetrics(context.Background())
+
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+retry:
+	for i := 0; metricsBytes == nil && i < r.scrapeRetries; i++ {
+		if !deadline.IsZero() && time.Now().Add(r.scrapeRetryDelay).After(deadline) {
+			break
+		}
+		select {
+		case <-time.After(r.scrapeRetryDelay):
+		case <-stop:
+			break retry
+		}
+		logger.WithFields(logrus.Fields{
+			"attempt":       i + 1,
+			"resource_name": r.name,
+			"resource_url":  r.resURL,
+		}).Debug("Retrying scrape.")
+		metricsBytes = r.getMetrics(ctx)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if metricsBytes != nil {
+		r.cache = metricsBytes
+		r.scrapeFailed = false
+		r.failures = 0
+	} else {
+		r.scrapeFailed = true
+		r.failures++
+	}
+}
+
+// decides what is pushed based on the result of the last scrape
+//
+// While the last scrape failed, the on_scrape_failure policy
+// decides whether the metrics to be transformed are replaced
+// or pushed groups are deleted.
+//
+func (r *resource) preparePush(cfg *pusherConfig) (*transformJob, []*pushJob) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	switch {
+	case !r.scrapeFailed && r.cache != nil:
+		return &transformJob{r: r, cfg: cfg, data: r.cache}, nil
+	case !r.scrapeFailed:
+		return nil, nil
+	case r.onFailure == scrapeFailureUp:
+		return nil, r.upPushes(cfg)
+	case r.onFailure == scrapeFailureZero && r.cache != nil:
+		return &transformJob{r: r, cfg: cfg, data: r.cache, zero: true}, nil
+	case r.onFailure == scrapeFailureDelete:
+		// groups are deleted only once per outage
+		deletes := make([]*pushJob, 0, len(r.pushedDsts))
+		for g := range r.pushedDsts {
+			deletes = append(deletes, &pushJob{r: r, method: http.MethodDelete, dst: g.dst, value: g.value})
+			delete(r.pushedDsts, g)
+		}
+		return nil, deletes
+	default:
+		return nil, nil
+	}
 }
 
-// gets metrics, does inverse-multiplexing on the data
-// by metrics names and route definitions and pushes the
-// data into promethei
+// creates pushes replacing all the pushed groups by `up 0`, so
+// no series of the last successful scrape are left, the caller
+// holds the lock
 //
-func (r *resource) getAndPush(wgImux *sync.WaitGroup, cfg *pusherConfig) {
-	defer wgImux.Done()
-	wgPush := &sync.WaitGroup{}
-	if metricsBytes := r.getMetrics(); metricsBytes != nil {
-		m := newMetrics(metricsBytes, cfg)
-		for dst, body := range m.imux(r.routes, cfg) {
-			wgPush.Add(1)
-			go r.pushMetrics(body, dst, wgPush)
+// Before anything is pushed, `up 0` is pushed where the route
+// map sends it.
+//
+func (r *resource) upPushes(cfg *pusherConfig) []*pushJob {
+	routed := newMetrics([]byte("# TYPE up gauge\nup 0\n"), cfg).imux(r.routes, cfg)
+	var body []byte
+	for dst, b := range routed {
+		body = b
+		if len(r.pushedDsts) == 0 {
+			r.pushedDsts[pushGroup{dst: dst}] = true
+		}
+	}
+
+	// PUT replaces the whole group, not only metrics of the same name
+	pushes := make([]*pushJob, 0, len(r.pushedDsts))
+	for g := range r.pushedDsts {
+		pushes = append(pushes, &pushJob{r: r, method: http.MethodPut, dst: g.dst, value: g.value, body: body})
+	}
+	return pushes
+}
+
+// enforces max_series of the resource, fails if the limit is
+// exceeded unless the metrics should be truncated
+//
+func (r *resource) limitSeries(data []byte) ([]byte, error) {
+	truncated, total, err := truncateSeries(data, r.maxSeries)
+	if err != nil || total <= r.maxSeries {
+		return data, err
+	}
+
+	self.add("prometheus_pusher_series_limit_exceeded_total", 1, "resource", r.name)
+	if r.seriesAction == seriesLimitFail {
+		return nil, fmt.Errorf("%d series exceed max_series %d", total, r.maxSeries)
+	}
+	logger.WithFields(logrus.Fields{
+		"limit":         r.maxSeries,
+		"series":        total,
+		"resource_name": r.name,
+		"resource_url":  r.resURL,
+	}).Warn("Scraped metrics exceed max_series, truncating.")
+	return truncated, nil
+}
+
+// transforms metrics and does inverse-multiplexing on the data
+// by metrics names and route definitions, returns requests
+// pushing the data into promethei
+//
+// With group_by_label the metrics are partitioned by value of the
+// label first and each partition is pushed as its own group.
+//
+func (r *resource) transformMetrics(job *transformJob) []*pushJob {
+	metricsBytes, err := r.transform.apply(job.data)
+	if err == nil && job.zero {
+		metricsBytes, err = zeroMetrics(metricsBytes)
+	}
+	if err == nil && r.maxSeries > 0 {
+		metricsBytes, err = r.limitSeries(metricsBytes)
+	}
+	parts := map[string][]byte{"": metricsBytes}
+	if err == nil && r.groupByLabel != "" {
+		parts, err = partitionMetrics(metricsBytes, r.groupByLabel)
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error":         err.Error(),
+			"resource_name": r.name,
+			"resource_url":  r.resURL,
+		}).Error("Failed to transform metrics.")
+		return nil
+	}
+
+	pushes := make([]*pushJob, 0)
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for value, data := range parts {
+		m := newMetrics(data, job.cfg)
+		for dst, body := range m.imux(r.routes, job.cfg) {
+			r.pushedDsts[pushGroup{dst: dst, value: value}] = true
+			pushes = append(pushes, &pushJob{r: r, method: http.MethodPost, dst: dst, value: value, body: body})
 		}
 	}
+	return pushes
 }
@@ -1,25 +1,662 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
 
 func TestResources(t *testing.T) {
-	grm := newRouteMap("test/routes", "test")
+	grm, _ := newRouteMap("test/routes", "test")
 	c, _ := parseConfig(cfgTest)
 	var r *resources
 	t.Run("create", func(t *testing.T) {
-		r = createResources(c, grm)
+		var err error
+		r, err = createResources(c, grm)
+		if err != nil {
+			t.Fatalf("Failed to create resources - %s", err.Error())
+		}
 	})
 	t.Run("run", func(t *testing.T) {
 		<-r.run()
 	})
+	t.Run("due", func(t *testing.T) {
+		now := time.Now()
+		if !isDue(time.Time{}, 3*time.Second, now, time.Second) {
+			t.Fatalf("Action which never ran should be due")
+		}
+		if isDue(now, 3*time.Second, now.Add(2*time.Second), time.Second) {
+			t.Fatalf("Action should not be due before its interval elapses")
+		}
+		if !isDue(now, 3*time.Second, now.Add(2600*time.Millisecond), time.Second) {
+			t.Fatalf("Action should be due within half a tick of its interval")
+		}
+	})
 	t.Run("process", func(t *testing.T) {
 		r.process(c)
+		r.pipeline.wait()
+	})
+	t.Run("reload", func(t *testing.T) {
+		r.rs["resource1"].failures = 2
+		deferred := &pushJob{r: r.rs["resource1"], method: http.MethodPost, dst: "test1"}
+		r.rs["resource1"].deferred[pushGroup{dst: "test1"}] = &deferredPush{until: time.Now().Add(time.Minute), job: deferred}
+		nc, err := parseConfig(append(cfgTest, []byte("\n[resource3]\nport = 9100\n")...))
+		if err != nil {
+			t.Fatalf("Failed to parse config - %s", err.Error())
+		}
+		if err := r.reload(nc, grm); err != nil {
+			t.Fatalf("Failed to reload - %s", err.Error())
+		}
+		if len(r.rs) != 3 || r.rs["resource3"] == nil {
+			t.Fatalf("Expected resources from new config, got %d resources", len(r.rs))
+		}
+		if r.rs["resource1"].failures != 2 {
+			t.Fatalf("State of resource1 should be carried over reload")
+		}
+		jobs := r.rs["resource1"].retries(time.Now().Add(2 * time.Minute))
+		if len(jobs) != 1 || jobs[0].r != r.rs["resource1"] {
+			t.Fatalf("Deferred push of resource1 should be carried over reload")
+		}
+	})
+	t.Run("reload invalid", func(t *testing.T) {
+		old := r.rs["resource1"]
+		nc, err := parseConfig(append(cfgTest, []byte("\n[resource4]\nport = 9100\nroute_map = \"test/missing\"\n")...))
+		if err != nil {
+			t.Fatalf("Failed to parse config - %s", err.Error())
+		}
+		if err := r.reload(nc, grm); err == nil {
+			t.Fatalf("Reload of config with missing route map should fail")
+		}
+		if len(r.rs) != 3 || r.rs["resource1"] != old {
+			t.Fatalf("Resources should be kept when reload fails")
+		}
 	})
 	t.Run("shutdown", func(t *testing.T) {
 		r.shutdown()
 	})
 	t.Run("stop", func(t *testing.T) {
 		<-r.stop()
+		r.pipeline.stop()
 	})
 
 }
+
+func TestSchedule(t *testing.T) {
+	c, err := parseConfig([]byte(`
+[config]
+push_interval = 60
+route_map = "test/routes"
+
+[every90]
+port = 9100
+push_interval = 90
+
+[every60]
+port = 9101
+
+[every45]
+port = 9102
+push_interval = 45
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config - %s", err.Error())
+	}
+
+	rs, err := createResources(c, nil)
+	if err != nil {
+		t.Fatalf("Failed to create resources - %s", err.Error())
+	}
+	defer rs.pipeline.stop()
+	defer rs.ticker.Stop()
+	if rs.tick != 15*time.Second {
+		t.Fatalf("Expected tick of 15s, got %s", rs.tick)
+	}
+
+	// runs within 6 minutes, including the first one
+	runCases := map[string]int{"every90": 5, "every60": 7, "every45": 9}
+	start := time.Now()
+	for name, expect := range runCases {
+		r := rs.rs[name]
+		runs := 0
+		var last time.Time
+		for now := start; !now.After(start.Add(6 * time.Minute)); now = now.Add(rs.tick) {
+			if isDue(last, r.pushInterval, now, rs.tick) {
+				if !last.IsZero() && now.Sub(last) != r.pushInterval {
+					t.Fatalf("Resource '%s' ran %s after the previous run", name, now.Sub(last))
+				}
+				runs++
+				last = now
+			}
+		}
+		if runs != expect {
+			t.Fatalf("Resource '%s' expected to run %d times, ran %d times", name, expect, runs)
+		}
+	}
+}
+
+func TestPushTenant(t *testing.T) {
+	var tenant string
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tenant = req.Header.Get("X-Scope-OrgID")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gw.Close()
+
+	dummy = false
+	defer func() { dummy = true }()
+
+	r := &resource{
+		name:           "resource1",
+		job:            "resource1",
+		instance:       hostname,
+		pushGatewayURL: gw.URL + "/%s",
+		tenantID:       "acme",
+		httpClient:     &http.Client{},
+	}
+	r.send(http.MethodPost, []byte("go_goroutines 24\n"), "metrics", "")
+
+	if tenant != "acme" {
+		t.Fatalf("Expected X-Scope-OrgID header to be 'acme', got '%s'", tenant)
+	}
+}
+
+func TestScrapeCache(t *testing.T) {
+	var scrapes, pushes int32
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&scrapes, 1)
+		w.Write([]byte("go_goroutines 24\n"))
+	}))
+	defer exporter.Close()
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&pushes, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gw.Close()
+
+	dummy = false
+	defer func() { dummy = true }()
+
+	c, _ := parseConfig(cfgTest)
+	r := newTestResource(exporter.URL, gw.URL)
+
+	runCycle(r, c, true, false)
+	if atomic.LoadInt32(&scrapes) != 1 || atomic.LoadInt32(&pushes) != 0 || r.cache == nil {
+		t.Fatalf("Scrape-only cycle expected to scrape once and cache metrics, got %d scrapes and %d pushes", scrapes, pushes)
+	}
+
+	runCycle(r, c, false, true)
+	// go_ metrics are routed to two destinations
+	if atomic.LoadInt32(&scrapes) != 1 || atomic.LoadInt32(&pushes) != 2 {
+		t.Fatalf("Push-only cycle expected to push cached metrics, got %d scrapes and %d pushes", scrapes, pushes)
+	}
+}
+
+func TestScrapeFailure(t *testing.T) {
+	var failing int32
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// routed into metrics, test1, test2 and test-bck
+		w.Write([]byte("test_value 24\ngo_goroutines 5\nhttp_requests 3\n"))
+	}))
+	defer exporter.Close()
+
+	gw := newTestGateway()
+	defer gw.Close()
+
+	dummy = false
+	defer func() { dummy = true }()
+
+	c, _ := parseConfig(cfgTest)
+	policyCases := []struct {
+		policy string
+		expect string   // part of every request sent after failed scrape
+		kept   bool     // whether the groups are left as they were
+		group  []string // metrics left in every group otherwise
+	}{
+		{scrapeFailureSkip, "", true, nil},
+		{scrapeFailureUp, "PUT ", false, []string{"up"}},
+		{scrapeFailureZero, " 0 ", true, nil},
+		{scrapeFailureDelete, "DELETE ", false, nil},
+	}
+
+	for _, pc := range policyCases {
+		t.Run(pc.policy, func(t *testing.T) {
+			gw.reset()
+			r := newTestResource(exporter.URL, gw.URL)
+			r.onFailure = pc.policy
+
+			// successful cycle so there is something cached and pushed
+			atomic.StoreInt32(&failing, 0)
+			runCycle(r, c, true, true)
+
+			gw.mtx.Lock()
+			gw.requests = gw.requests[:0]
+			before := make(map[string][]string)
+			for group := range gw.groups {
+				before[group] = gw.metrics(group)
+			}
+			gw.mtx.Unlock()
+			if len(before) != 4 {
+				t.Fatalf("Expected 4 pushed groups, got %d", len(before))
+			}
+
+			atomic.StoreInt32(&failing, 1)
+			runCycle(r, c, true, true)
+
+			gw.mtx.Lock()
+			defer gw.mtx.Unlock()
+			if pc.expect == "" && len(gw.requests) != 0 {
+				t.Fatalf("Expected no requests after failed scrape, got %v", gw.requests)
+			}
+			if pc.expect != "" && len(gw.requests) != len(before) {
+				t.Fatalf("Expected request into each of %d groups after failed scrape, got %v", len(before), gw.requests)
+			}
+			for _, req := range gw.requests {
+				if !strings.Contains(req, pc.expect) {
+					t.Fatalf("Expected request containing `%s` after failed scrape, got %s", pc.expect, req)
+				}
+			}
+			for group, names := range before {
+				expect := pc.group
+				if pc.kept {
+					expect = names
+				}
+				if got := gw.metrics(group); strings.Join(got, ",") != strings.Join(expect, ",") {
+					t.Fatalf("Expected group %s to contain %v after failed scrape, got %v", group, expect, got)
+				}
+			}
+		})
+	}
+}
+
+// mock pushgateway keeping metrics of each group the way
+// pushgateway does, POST replaces metrics of the same name,
+// PUT replaces the whole group and DELETE removes it
+//
+type testGateway struct {
+	*httptest.Server
+	mtx      sync.Mutex
+	requests []string
+	groups   map[string]map[string]bool // metric names by group URL
+}
+
+func newTestGateway() *testGateway {
+	gw := &testGateway{groups: make(map[string]map[string]bool)}
+	gw.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		var parser expfmt.TextParser
+		mfs, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		gw.mtx.Lock()
+		defer gw.mtx.Unlock()
+		gw.requests = append(gw.requests, req.Method+" "+string(body))
+		group := "http://" + req.Host + req.URL.String()
+		switch req.Method {
+		case http.MethodDelete:
+			delete(gw.groups, group)
+		case http.MethodPut:
+			gw.groups[group] = make(map[string]bool)
+		}
+		if gw.groups[group] == nil && req.Method != http.MethodDelete {
+			gw.groups[group] = make(map[string]bool)
+		}
+		for name := range mfs {
+			gw.groups[group][name] = true
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return gw
+}
+
+func (gw *testGateway) reset() {
+	gw.mtx.Lock()
+	defer gw.mtx.Unlock()
+	gw.requests = gw.requests[:0]
+	gw.groups = make(map[string]map[string]bool)
+}
+
+// sorted names of metrics in the group, the caller holds the lock
+//
+func (gw *testGateway) metrics(group string) []string {
+	names := make([]string, 0)
+	for name := range gw.groups[group] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil
+	}
+	return names
+}
+
+// runs scrape and push cycle of the resource synchronously,
+// the same way the pipeline stages do
+//
+func runCycle(r *resource, cfg *pusherConfig, scrape bool, push bool) {
+	if scrape {
+		r.scrape(time.Time{}, nil)
+	}
+	if !push {
+		return
+	}
+	tj, pushes := r.preparePush(cfg)
+	if tj != nil {
+		pushes = append(pushes, r.transformMetrics(tj)...)
+	}
+	for _, pj := range pushes {
+		r.push(pj)
+	}
+}
+
+// creates resource scraping given exporter and pushing into
+// given pushgateway, all metrics are routed to single destination
+//
+func newTestResource(exporterURL string, gwURL string) *resource {
+	routes, _ := newRouteMap("test/routes", "metrics")
+	return &resource{
+		name:           "resource1",
+		job:            "resource1",
+		instance:       hostname,
+		pushGatewayURL: gwURL + "/%s/metrics",
+		resURL:         exporterURL,
+		onFailure:      scrapeFailureSkip,
+		mtx:            &sync.Mutex{},
+		pushedDsts:     make(map[pushGroup]bool),
+		deferred:       make(map[pushGroup]*deferredPush),
+		transform:      &transform{},
+		routes:         routes,
+		httpClient:     &http.Client{},
+		scrapeClient:   &http.Client{},
+	}
+}
+
+func TestPushURL(t *testing.T) {
+	urlCases := []struct {
+		gw     string
+		params map[string]string
+		append bool // append_metrics_path
+		value  string
+		expect string
+	}{
+		{"http://%s:9091/metrics", nil, false, "", "http://test1:9091/metrics/job/resource1/instance/" + hostname},
+		{"http://static:9091/metrics/", nil, false, "", "http://static:9091/metrics/job/resource1/instance/" + hostname},
+		// path is kept as it is unless append_metrics_path is set
+		{"http://%s.somedomain.com:9092", nil, false, "", "http://test1.somedomain.com:9092/job/resource1/instance/" + hostname},
+		{"https://obs.example.com/pushgateway/", nil, false, "", "https://obs.example.com/pushgateway/job/resource1/instance/" + hostname},
+		{"https://obs.example.com/pushgateway/", nil, true, "", "https://obs.example.com/pushgateway/metrics/job/resource1/instance/" + hostname},
+		{"http://static:9091/metrics", nil, true, "", "http://static:9091/metrics/job/resource1/instance/" + hostname},
+		{"https://obs.example.com/%s/?token=abc", nil, true, "", "https://obs.example.com/test1/metrics/job/resource1/instance/" + hostname + "?token=abc"},
+		{"http://static:9091", map[string]string{"route": "eu"}, true, "", "http://static:9091/metrics/job/resource1/instance/" + hostname + "?route=eu"},
+		{"http://static:9091/metrics", nil, false, "3", "http://static:9091/metrics/job/resource1/instance/" + hostname + "/worker_id/3"},
+		{"http://static:9091/metrics", nil, false, "a/b", "http://static:9091/metrics/job/resource1/instance/" + hostname + "/worker_id@base64/YS9i"},
+	}
+
+	for _, c := range urlCases {
+		t.Run(c.gw+c.value, func(t *testing.T) {
+			r := &resource{name: "resource1", job: "resource1", instance: hostname, pushGatewayURL: c.gw,
+				pushParams: c.params, appendMetrics: c.append, groupByLabel: "worker_id"}
+			u, err := r.pushURL("test1", c.value)
+			if err != nil {
+				t.Fatalf("Failed to build push URL - %s", err.Error())
+			}
+			if u != c.expect {
+				t.Fatalf("Expected push URL %s, got %s", c.expect, u)
+			}
+		})
+	}
+}
+
+func TestHostOverrides(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("test_value 1\n"))
+	}))
+	defer exporter.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(exporter.URL, "http://"))
+
+	c, err := parseConfig(append(cfgTest, []byte(`
+[config.hosts]
+"exporter.lab.invalid" = "127.0.0.1"
+`)...))
+	if err != nil {
+		t.Fatalf("Failed to parse config - %s", err.Error())
+	}
+
+	client := newScrapeClient(&resourceConfig{}, c.hosts)
+	resp, err := client.Get("http://exporter.lab.invalid:" + port + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to scrape host with static address - %s", err.Error())
+	}
+	resp.Body.Close()
+
+	if _, err := parseConfig(append(cfgTest, []byte("[config.hosts]\nexporter = \"10.0.0\"\n")...)); err == nil {
+		t.Fatalf("Invalid static address should be rejected")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var mtx sync.Mutex
+	bodies := make([]string, 0)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gw.Close()
+
+	dummy = false
+	defer func() { dummy = true }()
+
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	r := newTestResource("", gw.URL)
+	r.archiveDir = dir
+	r.archiveKeep = 10
+	r.push(&pushJob{r: r, method: http.MethodPost, dst: "metrics", body: []byte("test_value 1\n")})
+	r.push(&pushJob{r: r, method: http.MethodPost, dst: "metrics", body: []byte("test_value 2\n")})
+	if len(r.retries(time.Now())) != 0 {
+		t.Fatalf("Push should be deferred until Retry-After elapses")
+	}
+
+	jobs := r.retries(time.Now().Add(2 * time.Minute))
+	if len(jobs) != 1 {
+		t.Fatalf("Expected single deferred push, got %d", len(jobs))
+	}
+	r.push(jobs[0])
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(bodies) != 2 || bodies[1] != "test_value 2\n" {
+		t.Fatalf("Expected the latest payload to be pushed after backing off, got %q", bodies)
+	}
+
+	// only the payload which made it through is archived
+	files, _ := listArchive(dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected single archived payload, got %d", len(files))
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if !strings.Contains(string(data), " status 202\n# destination metrics\ntest_value 2\n") {
+		t.Fatalf("Unexpected archived payload:\n%s", data)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	retryCases := []struct {
+		header string
+		wait   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"30", 30 * time.Second, true},
+		{"Fri, 01 Mar 2019 12:01:00 GMT", time.Minute, true},
+		{"0", minRetryAfter, true},
+		{"Fri, 01 Mar 2019 11:00:00 GMT", minRetryAfter, true},
+		{"86400", maxRetryAfter, true},
+		{"Sat, 02 Mar 2019 12:00:00 GMT", maxRetryAfter, true},
+		{"99999999999999999999", 0, false},
+		{"soon", 0, false},
+	}
+	for _, c := range retryCases {
+		wait, ok := parseRetryAfter(c.header, now)
+		if wait != c.wait || ok != c.ok {
+			t.Fatalf("Retry-After `%s` expected to be %s/%t, got %s/%t", c.header, c.wait, c.ok, wait, ok)
+		}
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	c, _ := parseConfig(cfgTest)
+	data := []byte("test_value{id=\"1\"} 1\ntest_value{id=\"2\"} 2\n")
+
+	r := newTestResource("", "http://localhost")
+	r.maxSeries = 1
+	r.seriesAction = seriesLimitFail
+	if pushes := r.transformMetrics(&transformJob{r: r, cfg: c, data: data}); len(pushes) != 0 {
+		t.Fatalf("Metrics exceeding max_series should not be pushed")
+	}
+
+	r.seriesAction = seriesLimitTruncate
+	pushes := r.transformMetrics(&transformJob{r: r, cfg: c, data: data})
+	if len(pushes) != 1 || strings.Contains(string(pushes[0].body), `id="2"`) {
+		t.Fatalf("Expected metrics truncated to max_series, got %v", pushes)
+	}
+}
+
+func TestMultipleHosts(t *testing.T) {
+	c, err := parseConfig(append(cfgTest, []byte(`
+[mysql]
+hosts = ["db1.prod", "db2.prod"]
+port = 9104
+pushgateway_url = "http://pushgateway:9091/metrics"
+`)...))
+	if err != nil {
+		t.Fatalf("Failed to parse config - %s", err.Error())
+	}
+
+	rs, err := createResources(c, nil)
+	if err != nil {
+		t.Fatalf("Failed to create resources - %s", err.Error())
+	}
+	defer rs.pipeline.stop()
+	defer rs.ticker.Stop()
+
+	for _, host := range []string{"db1.prod", "db2.prod"} {
+		r := rs.rs["mysql@"+host]
+		if r == nil {
+			t.Fatalf("Missing resource of host %s", host)
+		}
+		if r.resURL != "http://"+host+":9104/metrics" {
+			t.Fatalf("Unexpected resource URL %s", r.resURL)
+		}
+		u, _ := r.pushURL("", "")
+		if u != "http://pushgateway:9091/metrics/job/mysql/instance/"+host {
+			t.Fatalf("Unexpected push URL %s", u)
+		}
+	}
+
+	if _, err := parseConfig([]byte("[mysql]\nhost = \"db1\"\nhosts = [\"db2\"]\nport = 9104\n")); err == nil {
+		t.Fatalf("Resource with both host and hosts should be rejected")
+	}
+}
+
+func TestScrapeRetries(t *testing.T) {
+	var requests int32
+	var failFirst int32
+	var hang int32
+	var slow int32
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= atomic.LoadInt32(&failFirst) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if atomic.LoadInt32(&hang) == 1 {
+			<-req.Context().Done()
+			return
+		}
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("test_value 1\n"))
+	}))
+	defer exporter.Close()
+
+	r := newTestResource(exporter.URL, "http://localhost")
+	r.scrapeRetries = 3
+	r.scrapeRetryDelay = 10 * time.Millisecond
+
+	atomic.StoreInt32(&failFirst, 2)
+	r.scrape(time.Now().Add(time.Second), nil)
+	if r.scrapeFailed || atomic.LoadInt32(&requests) != 3 {
+		t.Fatalf("Expected scrape to succeed on the third attempt, got %d attempts", requests)
+	}
+
+	// retries must not run into the next scrape
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&failFirst, 10)
+	r.scrapeRetryDelay = 100 * time.Millisecond
+	r.scrape(time.Now().Add(150*time.Millisecond), nil)
+	if !r.scrapeFailed || atomic.LoadInt32(&requests) != 2 {
+		t.Fatalf("Expected single retry before the next scrape, got %d attempts", requests)
+	}
+
+	// retries are given up when stopping
+	atomic.StoreInt32(&requests, 0)
+	stop := make(chan struct{})
+	close(stop)
+	r.scrape(time.Now().Add(time.Second), stop)
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("Expected no retries while stopping, got %d attempts", requests)
+	}
+
+	// hanging retry is cut off by the deadline
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&failFirst, 1)
+	atomic.StoreInt32(&hang, 1)
+	r.scrapeRetryDelay = 10 * time.Millisecond
+	start := time.Now()
+	r.scrape(start.Add(100*time.Millisecond), nil)
+	if !r.scrapeFailed || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("Expected scrape to fail by the deadline, took %s", time.Since(start))
+	}
+
+	// the first attempt isn't limited by the deadline
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&failFirst, 0)
+	atomic.StoreInt32(&hang, 0)
+	atomic.StoreInt32(&slow, 1)
+	r.scrapeRetries = 0
+	r.scrape(time.Now().Add(50*time.Millisecond), nil)
+	if r.scrapeFailed {
+		t.Fatalf("Slow scrape without retries should succeed after the deadline")
+	}
+}
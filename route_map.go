@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"strings"
 
@@ -19,17 +20,17 @@ type routeMap struct {
 
 // creates routeMap instance from a route_map config file
 //
-func newRouteMap(file string, dr string) *routeMap {
+func newRouteMap(file string, dr string) (*routeMap, error) {
 	m := iradix.New()
 
 	fd, err := os.Open(file)
 	if err != nil {
-		logger.Fatalf("Failed to parse route map %s - %s", file, err.Error())
-		return nil
+		return nil, fmt.Errorf("failed to read route map - %s", err.Error())
 	}
+	defer fd.Close()
 
 	sc := bufio.NewScanner(fd)
-	for sc.Scan() {
+	for line := 1; sc.Scan(); line++ {
 		if sc.Text() == "" {
 			continue
 		}
@@ -38,11 +39,17 @@ func newRouteMap(file string, dr string) *routeMap {
 		}
 
 		elem := strings.Fields(sc.Text())
+		if len(elem) < 2 {
+			return nil, fmt.Errorf("route map %s line %d - expected prefix and destinations", file, line)
+		}
 		rt := strings.Split(elem[1], ",")
 		m, _, _ = m.Insert([]byte(elem[0]), rt)
 	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read route map %s - %s", file, err.Error())
+	}
 	r := &routeMap{m, strings.Split(dr, ",")}
-	return r
+	return r, nil
 }
 
 // calculates route for given metric name
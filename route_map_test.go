@@ -1,6 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -20,7 +23,11 @@ func TestRouteMap(t *testing.T) {
 	}
 
 	t.Run("new", func(t *testing.T) {
-		rm = newRouteMap("test/routes", "test0,test-bck")
+		var err error
+		rm, err = newRouteMap("test/routes", "test0,test-bck")
+		if err != nil {
+			t.Fatalf("Failed to read route map - %s", err.Error())
+		}
 		if rm.Len() != 26 {
 			t.Fatalf("Route map should contain 26 elements, but has %d", rm.Len())
 		}
@@ -43,3 +50,22 @@ func TestRouteMap(t *testing.T) {
 		}
 	})
 }
+
+func TestRouteMapInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher-routes")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "routes")
+	if err := ioutil.WriteFile(file, []byte("go_ test1\nhttp_\n"), 0644); err != nil {
+		t.Fatalf("Failed to write route map - %s", err.Error())
+	}
+
+	if _, err := newRouteMap(file, "test"); err == nil {
+		t.Fatalf("Route map with line missing destinations should fail")
+	}
+	if _, err := newRouteMap("test/missing", "test"); err == nil {
+		t.Fatalf("Missing route map should fail")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// series selector in Prometheus syntax, e.g.
+// `node_cpu{cpu="idle",mode=~"user|system"}`
+//
+type selector struct {
+	raw      string
+	matchers []*labelMatcher
+}
+
+// single label matcher of a selector
+//
+type labelMatcher struct {
+	name  string
+	op    string // one of `=`, `!=`, `=~`, `!~`
+	value string
+	re    *regexp.Regexp
+}
+
+// parses series selector
+//
+func newSelector(s string) (*selector, error) {
+	sel := &selector{raw: s}
+	rest := strings.TrimSpace(s)
+
+	// optional metric name before the braces
+	if i := strings.IndexByte(rest, '{'); i != 0 {
+		name := rest
+		if i > 0 {
+			name = rest[:i]
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty selector")
+		}
+		sel.matchers = append(sel.matchers, &labelMatcher{name: "__name__", op: "=", value: name})
+		if i < 0 {
+			return sel, nil
+		}
+		rest = rest[i:]
+	}
+
+	if !strings.HasSuffix(rest, "}") {
+		return nil, fmt.Errorf("selector %s is missing closing brace", s)
+	}
+	rest = strings.TrimSpace(rest[1 : len(rest)-1])
+
+	for rest != "" {
+		m := &labelMatcher{}
+
+		i := strings.IndexAny(rest, "=!")
+		if i <= 0 {
+			return nil, fmt.Errorf("selector %s has matcher without label name", s)
+		}
+		m.name = strings.TrimSpace(rest[:i])
+		rest = rest[i:]
+
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(rest, op) {
+				m.op = op
+				break
+			}
+		}
+		if m.op == "" {
+			return nil, fmt.Errorf("selector %s has invalid operator", s)
+		}
+		rest = strings.TrimSpace(rest[len(m.op):])
+
+		value, n, err := unquotePrefix(rest)
+		if err != nil {
+			return nil, fmt.Errorf("selector %s has invalid value - %s", s, err.Error())
+		}
+		m.value = value
+		rest = strings.TrimSpace(rest[n:])
+
+		if m.op == "=~" || m.op == "!~" {
+			if m.re, err = regexp.Compile("^(?:" + m.value + ")$"); err != nil {
+				return nil, fmt.Errorf("selector %s has invalid expression - %s", s, err.Error())
+			}
+		}
+		sel.matchers = append(sel.matchers, m)
+
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if rest != "" {
+			return nil, fmt.Errorf("selector %s has matchers not separated by comma", s)
+		}
+	}
+
+	if len(sel.matchers) == 0 {
+		return nil, fmt.Errorf("selector %s has no matchers", s)
+	}
+	return sel, nil
+}
+
+// reads quoted string from the beginning of s, returns its
+// unquoted value and length of the quoted part
+//
+func unquotePrefix(s string) (string, int, error) {
+	if len(s) == 0 || (s[0] != '"' && s[0] != '`') {
+		return "", 0, fmt.Errorf("value has to be quoted")
+	}
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' && s[0] != '`' {
+			i++
+			continue
+		}
+		if s[i] == s[0] {
+			v, err := strconv.Unquote(s[:i+1])
+			return v, i + 1, err
+		}
+	}
+	return "", 0, fmt.Errorf("value is missing closing quote")
+}
+
+// checks whether the series of given metric family matches
+// all matchers of the selector
+//
+// Series of histograms and summaries are matched by the name
+// of the family, without `_bucket`, `_sum` or `_count` suffix,
+// buckets and quantiles aren't matched separately.
+//
+func (sel *selector) matches(name string, m *dto.Metric) bool {
+	for _, lm := range sel.matchers {
+		if !lm.matches(labelValue(name, m, lm.name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (lm *labelMatcher) matches(v string) bool {
+	switch lm.op {
+	case "=":
+		return v == lm.value
+	case "!=":
+		return v != lm.value
+	case "=~":
+		return lm.re.MatchString(v)
+	default:
+		return !lm.re.MatchString(v)
+	}
+}
+
+// value of the label of given series, missing labels
+// have empty value
+//
+func labelValue(name string, m *dto.Metric, label string) string {
+	if label == "__name__" {
+		return name
+	}
+	for _, lp := range m.Label {
+		if lp.GetName() == label {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSelector(t *testing.T) {
+	newSeries := func(labels ...string) *dto.Metric {
+		m := &dto.Metric{}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: &labels[i], Value: &labels[i+1]})
+		}
+		return m
+	}
+
+	matchCases := []struct {
+		sel    string
+		name   string
+		series *dto.Metric
+		expect bool
+	}{
+		{`{cpu="idle"}`, "node_cpu", newSeries("cpu", "idle"), true},
+		{`{cpu="idle"}`, "node_cpu", newSeries("cpu", "user"), false},
+		{`node_cpu{cpu!="idle"}`, "node_cpu", newSeries("cpu", "user"), true},
+		{`node_cpu{cpu!="idle"}`, "node_load1", newSeries("cpu", "user"), false},
+		{`{mountpoint=~"/var/lib/docker/.*"}`, "node_fs", newSeries("mountpoint", "/var/lib/docker/overlay"), true},
+		{`{mountpoint=~"/var/lib/docker/.*"}`, "node_fs", newSeries("mountpoint", "/var"), false},
+		{`{ mountpoint !~ "/var.*", fstype="ext4" }`, "node_fs", newSeries("mountpoint", "/", "fstype", "ext4"), true},
+		{`{device=""}`, "node_fs", newSeries("mountpoint", "/"), true},
+		{`go_goroutines`, "go_goroutines", newSeries(), true},
+	}
+
+	for _, c := range matchCases {
+		t.Run(c.sel, func(t *testing.T) {
+			sel, err := newSelector(c.sel)
+			if err != nil {
+				t.Fatalf("Failed to parse selector - %s", err.Error())
+			}
+			if sel.matches(c.name, c.series) != c.expect {
+				t.Fatalf("Selector `%s` expected to match `%s%s`: %t", c.sel, c.name, c.series.Label, c.expect)
+			}
+		})
+	}
+
+	for _, s := range []string{`{}`, `{cpu}`, `{cpu=idle}`, `{cpu="idle"`, `{cpu="idle" mode="user"}`, `{cpu=~"("}`} {
+		if _, err := newSelector(s); err == nil {
+			t.Fatalf("Invalid selector `%s` should be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// internal metrics of the pusher itself, exposed in text
+// format on the internal listener
+//
+type selfMetrics struct {
+	mtx     sync.Mutex
+	metrics map[string]*selfMetric
+}
+
+// single self metric with values by their label sets
+//
+type selfMetric struct {
+	help   string
+	typ    string
+	values map[string]float64
+}
+
+var (
+	self         = newSelfMetrics()
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+func newSelfMetrics() *selfMetrics {
+	s := &selfMetrics{metrics: make(map[string]*selfMetric)}
+	s.register("prometheus_pusher_config_parse_duration_seconds", "gauge",
+		"Duration of the last configuration load and parse.")
+	s.register("prometheus_pusher_config_files", "gauge",
+		"Number of configuration files loaded.")
+	s.register("prometheus_pusher_config_last_reload_successful", "gauge",
+		"Whether the last configuration reload attempt was successful.")
+	s.register("prometheus_pusher_series_limit_exceeded_total", "counter",
+		"Number of scrapes whose metrics exceeded max_series of the resource.")
+	s.register("prometheus_pusher_queue_length", "gauge",
+		"Number of jobs waiting in the queue of a pipeline stage.")
+	s.register("prometheus_pusher_queue_dropped_total", "counter",
+		"Number of jobs dropped because the queue of a pipeline stage was full.")
+	return s
+}
+
+// registers metric, so it's exposed even before first value
+// is observed
+//
+func (s *selfMetrics) register(name string, typ string, help string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.metrics[name] = &selfMetric{help: help, typ: typ, values: make(map[string]float64)}
+}
+
+// sets value of the metric with given label name-value pairs
+//
+func (s *selfMetrics) set(name string, v float64, labels ...string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.metrics[name].values[formatLabels(labels)] = v
+}
+
+// adds to value of the metric with given label name-value pairs
+//
+func (s *selfMetrics) add(name string, v float64, labels ...string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.metrics[name].values[formatLabels(labels)] += v
+}
+
+// renders all the metrics in text format sorted by name
+// and labels
+//
+func (s *selfMetrics) render() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	names := make([]string, 0, len(s.metrics))
+	for name := range s.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		m := s.metrics[name]
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, m.help, name, m.typ)
+
+		labels := make([]string, 0, len(m.values))
+		for l := range m.values {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			fmt.Fprintf(&buf, "%s%s %s\n", name, l, strconv.FormatFloat(m.values[l], 'g', -1, 64))
+		}
+	}
+	return buf.Bytes()
+}
+
+// formats label name-value pairs as `{name="value",...}`
+//
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSelfMetrics(t *testing.T) {
+	s := &selfMetrics{metrics: make(map[string]*selfMetric)}
+	s.register("test_total", "counter", "Test counter.")
+	s.register("test_empty", "gauge", "Test gauge without values.")
+	s.add("test_total", 1, "resource", "b")
+	s.add("test_total", 2, "resource", "a\"quoted\"")
+	s.add("test_total", 1, "resource", "b")
+
+	expect := `# HELP test_empty Test gauge without values.
+# TYPE test_empty gauge
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{resource="a\"quoted\""} 2
+test_total{resource="b"} 2
+`
+	if got := string(s.render()); got != expect {
+		t.Fatalf("Unexpected self metrics rendering:\n%s", got)
+	}
+}
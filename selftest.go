@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// metrics served by the selftest exporter
+//
+var selftestMetrics = []byte(`# HELP jobs_total Jobs processed.
+# TYPE jobs_total counter
+jobs_total{queue="default"} 42
+jobs_total{queue="debug"} 7
+# HELP temperature_celsius Current temperature.
+# TYPE temperature_celsius gauge
+temperature_celsius 21.5
+# HELP request_duration_seconds Request duration.
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 3
+request_duration_seconds_bucket{le="1"} 5
+request_duration_seconds_bucket{le="+Inf"} 6
+request_duration_seconds_sum 2.5
+request_duration_seconds_count 6
+`)
+
+// request received by the mock pushgateway
+//
+type selftestRequest struct {
+	method string
+	path   string
+	body   []byte
+}
+
+// runs `selftest` subcommand, scrapes an in-process exporter and
+// pushes into a mock pushgateway using the real scrape, transform
+// and push code, writes report of the checks
+//
+func runSelftest(w io.Writer) error {
+	scraped := 0
+	var mtx sync.Mutex
+	exporter := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		scraped++
+		mtx.Unlock()
+		rw.Write(selftestMetrics)
+	}))
+	defer exporter.Close()
+
+	requests := make([]*selftestRequest, 0)
+	gw := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mtx.Lock()
+		requests = append(requests, &selftestRequest{method: req.Method, path: req.URL.Path, body: body})
+		mtx.Unlock()
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer gw.Close()
+
+	dir, err := ioutil.TempDir("", "prometheus-pusher-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	routes := filepath.Join(dir, "routes")
+	if err := ioutil.WriteFile(routes, []byte("selftest_ selftest\n"), 0644); err != nil {
+		return err
+	}
+
+	host, port, _ := net.SplitHostPort(exporter.Listener.Addr().String())
+	cfg, err := parseConfig([]byte(fmt.Sprintf(`
+[config]
+pushgateway_url = "%s/metrics"
+route_map = "%s"
+default_route = "selftest"
+
+[selftest]
+host = "%s"
+port = %s
+metric_prefix = "selftest_"
+drop_series = ['jobs_total{queue="debug"}']
+`, gw.URL, routes, host, port)))
+	if err != nil {
+		return err
+	}
+
+	// pushes are checked by the mock pushgateway, not printed
+	wasDummy := dummy
+	dummy = false
+	defer func() { dummy = wasDummy }()
+
+	r, err := newResource("selftest", "", cfg, nil)
+	if err != nil {
+		return err
+	}
+	p := newPipeline(1, 1, 1, 1)
+	r.setQueued(true)
+	p.enqueueScrape(&scrapeJob{r: r, cfg: cfg, scrape: true, push: true})
+	p.stop()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	failed := false
+	check := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(w, "FAIL %s - %s\n", name, err.Error())
+			return
+		}
+		fmt.Fprintf(w, "ok   %s\n", name)
+	}
+
+	var scrapeErr error
+	if scraped != 1 {
+		scrapeErr = fmt.Errorf("exporter was scraped %d times", scraped)
+	}
+	check("scrape", scrapeErr)
+
+	var pushErr error
+	path := "/metrics/job/selftest/instance/" + hostname
+	if len(requests) != 1 {
+		pushErr = fmt.Errorf("pushgateway got %d requests", len(requests))
+	} else if requests[0].method != http.MethodPost || requests[0].path != path {
+		pushErr = fmt.Errorf("unexpected request %s %s", requests[0].method, requests[0].path)
+	}
+	check("push", pushErr)
+
+	var payloadErr error
+	if pushErr == nil {
+		payloadErr = checkSelftestPayload(requests[0].body)
+	} else {
+		payloadErr = fmt.Errorf("nothing pushed")
+	}
+	check("transform", payloadErr)
+
+	if failed {
+		return fmt.Errorf("selftest failed")
+	}
+	return nil
+}
+
+// checks that pushed payload is valid and transformed as configured
+//
+func checkSelftestPayload(body []byte) error {
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid payload - %s", err.Error())
+	}
+
+	for _, name := range []string{"selftest_jobs_total", "selftest_temperature_celsius", "selftest_request_duration_seconds"} {
+		if _, ok := mfs[name]; !ok {
+			return fmt.Errorf("metric %s is missing", name)
+		}
+	}
+	if len(mfs) != 3 {
+		return fmt.Errorf("expected 3 metrics, got %d", len(mfs))
+	}
+	if n := len(mfs["selftest_jobs_total"].Metric); n != 1 {
+		return fmt.Errorf("expected dropped series to be missing, got %d series of selftest_jobs_total", n)
+	}
+	if n := len(mfs["selftest_request_duration_seconds"].Metric[0].GetHistogram().GetBucket()); n != 3 {
+		return fmt.Errorf("expected 3 histogram buckets, got %d", n)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSelftest(t *testing.T) {
+	var buf bytes.Buffer
+	if err := runSelftest(&buf); err != nil {
+		t.Fatalf("Selftest failed - %s\n%s", err.Error(), buf.String())
+	}
+	if strings.Contains(buf.String(), "FAIL") || strings.Count(buf.String(), "ok ") != 3 {
+		t.Fatalf("Unexpected selftest report:\n%s", buf.String())
+	}
+	if !dummy {
+		t.Fatalf("Selftest should restore dummy mode")
+	}
+}
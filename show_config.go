@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var urlPassword = regexp.MustCompile(`(://[^/@:]*:)[^/@]*@`)
+
+// runs `show-config` subcommand, prints effective config
+// loaded from given path to stdout
+//
+func runShowConfig(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	return cfg.render(os.Stdout)
+}
+
+// writes fully merged and defaulted config in TOML format,
+// passwords in URLs are redacted
+//
+func (p *pusherConfig) render(w io.Writer) error {
+	ew := &errWriter{w: w}
+
+	ew.printf("[config]\n")
+	ew.printf("pushgateway_url = %q\n", redactURL(p.pushGatewayURL))
+	ew.printf("push_interval = %d\n", int64(p.pushInterval.Seconds()))
+	if p.scrapeInterval != 0 {
+		ew.printf("scrape_interval = %d\n", int64(p.scrapeInterval.Seconds()))
+	}
+	if p.routeMap != "" {
+		ew.printf("route_map = %q\n", p.routeMap)
+	}
+	if p.defaultRoute != "" {
+		ew.printf("default_route = %q\n", p.defaultRoute)
+	}
+	if p.tenantID != "" {
+		ew.printf("tenant_id = %q\n", p.tenantID)
+	}
+	if p.appendMetrics {
+		ew.printf("append_metrics_path = true\n")
+	}
+	ew.printf("on_scrape_failure = %q\n", p.onScrapeFailure)
+	if p.archiveDir != "" {
+		ew.printf("archive_dir = %q\n", p.archiveDir)
+	}
+	ew.printf("archive_keep = %d\n", p.archiveKeep)
+	if p.netrcFile != "" {
+		ew.printf("netrc_file = %q\n", p.netrcFile)
+	}
+	if len(p.pushParams) > 0 {
+		ew.printf("\n[config.pushgateway_params]\n")
+		for _, k := range sortedKeys(p.pushParams) {
+			ew.printf("%q = %q\n", k, p.pushParams[k])
+		}
+	}
+
+	if len(p.hosts) > 0 {
+		ew.printf("\n[config.hosts]\n")
+		for _, k := range sortedKeys(p.hosts) {
+			ew.printf("%q = %q\n", k, p.hosts[k])
+		}
+	}
+
+	if len(p.envLabels) > 0 {
+		ew.printf("\n# labels added to all metrics from environment\n")
+		for _, k := range sortedKeys(p.envLabels) {
+			ew.printf("# %s = %q\n", k, p.envLabels[k])
+		}
+	}
+
+	names := make([]string, 0, len(p.resources))
+	for name := range p.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		res := p.resources[name]
+		ew.printf("\n[%s]\n", name)
+		if len(res.hosts) > 0 {
+			hosts := make([]string, 0, len(res.hosts))
+			for _, host := range res.hosts {
+				ew.printf("# resource_url = %q\n", redactURL(res.hostURL(host)))
+				hosts = append(hosts, fmt.Sprintf("%q", host))
+			}
+			ew.printf("hosts = [%s]\n", strings.Join(hosts, ", "))
+		} else {
+			ew.printf("# resource_url = %q\n", redactURL(res.resURL))
+			ew.printf("host = %q\n", res.host)
+		}
+		ew.printf("port = %d\n", res.port)
+		ew.printf("path = %q\n", "/"+res.path)
+		ew.printf("ssl = %t\n", res.ssl)
+		ew.printf("pushgateway_url = %q\n", redactURL(res.pushGatewayURL))
+		if res.appendMetrics {
+			ew.printf("append_metrics_path = true\n")
+		}
+		ew.printf("push_interval = %d\n", int64(res.pushInterval.Seconds()))
+		ew.printf("scrape_interval = %d\n", int64(res.scrapeInterval.Seconds()))
+		if res.scrapeRetries > 0 {
+			ew.printf("scrape_retries = %d\n", res.scrapeRetries)
+			ew.printf("scrape_retry_delay = %d\n", int64(res.scrapeRetryDelay.Seconds()))
+		}
+		if res.routeMap != "" {
+			ew.printf("route_map = %q\n", res.routeMap)
+		}
+		if res.defaultRoute != "" {
+			ew.printf("default_route = %q\n", res.defaultRoute)
+		}
+		if res.tenantID != "" {
+			ew.printf("tenant_id = %q\n", res.tenantID)
+		}
+		if res.sshTunnel != nil {
+			ew.printf("ssh_jump_host = %q\n", res.sshTunnel.addr)
+			ew.printf("ssh_user = %q\n", res.sshTunnel.user)
+			ew.printf("ssh_key = %q\n", res.sshTunnel.keyFile)
+			ew.printf("ssh_known_hosts = %q\n", res.sshTunnel.knownHosts)
+		}
+		ew.printf("on_scrape_failure = %q\n", res.onScrapeFailure)
+		if res.metricPrefix != "" {
+			ew.printf("metric_prefix = %q\n", res.metricPrefix)
+		}
+		if res.archiveDir != "" {
+			ew.printf("archive_dir = %q\n", res.archiveDir)
+			ew.printf("archive_keep = %d\n", res.archiveKeep)
+		}
+		if res.maxSeries > 0 {
+			ew.printf("max_series = %d\n", res.maxSeries)
+			ew.printf("max_series_action = %q\n", res.maxSeriesAction)
+		}
+		if res.dropQuantiles {
+			ew.printf("drop_quantiles = true\n")
+		}
+		if len(res.keepBuckets) > 0 {
+			les := make([]string, 0, len(res.keepBuckets))
+			for _, le := range res.keepBuckets {
+				les = append(les, strconv.Quote(strconv.FormatFloat(le, 'g', -1, 64)))
+			}
+			ew.printf("keep_buckets = [%s]\n", strings.Join(les, ", "))
+		}
+		if res.synthesizeType != "" {
+			ew.printf("synthesize_type = %q\n", res.synthesizeType)
+		}
+		if res.groupByLabel != "" {
+			ew.printf("group_by_label = %q\n", res.groupByLabel)
+		}
+		if len(res.dropSeries) > 0 {
+			sels := make([]string, 0, len(res.dropSeries))
+			for _, sel := range res.dropSeries {
+				sels = append(sels, fmt.Sprintf("%q", sel.raw))
+			}
+			ew.printf("drop_series = [%s]\n", strings.Join(sels, ", "))
+		}
+		if len(res.pushParams) > 0 {
+			ew.printf("\n[%s.pushgateway_params]\n", name)
+			for _, k := range sortedKeys(res.pushParams) {
+				ew.printf("%q = %q\n", k, res.pushParams[k])
+			}
+		}
+		if len(res.rename) > 0 {
+			ew.printf("\n[%s.rename]\n", name)
+			for _, rule := range res.rename {
+				ew.printf("%q = %q\n", rule.from, rule.to)
+			}
+		}
+	}
+
+	return ew.err
+}
+
+// replaces password in URL with `xxxxx`
+//
+func redactURL(u string) string {
+	return urlPassword.ReplaceAllString(u, "${1}xxxxx@")
+}
+
+// writer remembering the first error, so the rendering
+// doesn't have to check every single write
+//
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestShowConfig(t *testing.T) {
+	os.Setenv("FOO", "foo")
+	defer os.Unsetenv("FOO")
+
+	c, err := parseConfig(append(cfgTest, []byte(`
+[resource3]
+port = 9100
+pushgateway_url = "https://pusher:secret@%s/pushgateway"
+append_metrics_path = true
+drop_series = ['{cpu="idle"}']
+
+[resource3.rename]
+"~go_(.*)" = "golang_$1"
+`)...))
+	if err != nil {
+		t.Fatalf("Failed to parse config - %s", err.Error())
+	}
+
+	var buf bytes.Buffer
+	if err := c.render(&buf); err != nil {
+		t.Fatalf("Failed to render config - %s", err.Error())
+	}
+
+	if bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Fatalf("Rendered config contains unredacted password:\n%s", buf.String())
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`# foo = "foo"`)) {
+		t.Fatalf("Rendered config is missing env labels:\n%s", buf.String())
+	}
+
+	// rendered config has to be loadable and equivalent
+	rc, err := parseConfig(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse rendered config - %s\n%s", err.Error(), buf.String())
+	}
+	for name, res := range c.resources {
+		if rc.resources[name] == nil || rc.resources[name].resURL != res.resURL || rc.resources[name].appendMetrics != res.appendMetrics {
+			t.Fatalf("Resource '%s' doesn't match after rendering", name)
+		}
+	}
+}
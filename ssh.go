@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH jump host the resource is scraped through
+//
+type sshTunnel struct {
+	addr       string // host:port of the jump host
+	user       string
+	keyFile    string // private key used for authentication
+	knownHosts string // known_hosts file verifying the jump host
+}
+
+// pool of SSH connections shared by all resources tunneled
+// through the same jump host
+//
+type sshPool struct {
+	mtx     sync.Mutex
+	clients map[sshTunnel]*ssh.Client
+}
+
+var tunnels = &sshPool{clients: make(map[sshTunnel]*ssh.Client)}
+
+// returns path of known_hosts file in the home directory
+//
+func defaultKnownHosts() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// creates HTTP transport dialing all connections through
+// the tunnel
+//
+func (t sshTunnel) transport() *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return tunnels.dial(t, network, addr)
+		},
+	}
+}
+
+// dials address through the jump host, connection to the jump
+// host is re-established once if the pooled one is broken
+//
+// Channels rejected by the jump host, e.g. when the target is
+// down, are returned as they are, the connection is kept.
+//
+func (p *sshPool) dial(t sshTunnel, network string, addr string) (net.Conn, error) {
+	client, err := p.client(t)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial(network, addr)
+	if err == nil {
+		return conn, nil
+	}
+	if _, ok := err.(*ssh.OpenChannelError); ok {
+		return nil, err
+	}
+
+	logger.Warnf("Failed to dial %s through %s, reconnecting - %s", addr, t.addr, err.Error())
+	p.drop(t, client)
+	if client, err = p.client(t); err != nil {
+		return nil, err
+	}
+	return client.Dial(network, addr)
+}
+
+// returns pooled connection to the jump host or connects
+//
+func (p *sshPool) client(t sshTunnel) (*ssh.Client, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if client, ok := p.clients[t]; ok {
+		return client, nil
+	}
+
+	cfg, err := t.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.Dial("tcp", t.addr, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to jump host %s - %s", t.addr, err.Error())
+	}
+	p.clients[t] = client
+	return client, nil
+}
+
+// closes broken connection and removes it from the pool, unless
+// it was already replaced
+//
+func (p *sshPool) drop(t sshTunnel, client *ssh.Client) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.clients[t] == client {
+		delete(p.clients, t)
+	}
+	client.Close()
+}
+
+// reads private key and known hosts of the tunnel
+//
+func (t sshTunnel) clientConfig() (*ssh.ClientConfig, error) {
+	key, err := ioutil.ReadFile(t.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key %s - %s", t.keyFile, err.Error())
+	}
+	hostKeyCallback, err := knownhosts.New(t.knownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            t.user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         httpClientTimeout,
+	}, nil
+}
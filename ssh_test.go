@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestSSHTunnel(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("test_value 1\n"))
+	}))
+	defer exporter.Close()
+
+	dir, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	hostKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	hostSigner, _ := ssh.NewSignerFromKey(hostKey)
+	userKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	userSigner, _ := ssh.NewSignerFromKey(userKey)
+
+	jump := newTestJumpHost(t, hostSigner, userSigner.PublicKey())
+	defer jump.close()
+
+	tun := sshTunnel{
+		addr:       jump.ln.Addr().String(),
+		user:       "pusher",
+		keyFile:    filepath.Join(dir, "id_rsa"),
+		knownHosts: filepath.Join(dir, "known_hosts"),
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(userKey)})
+	ioutil.WriteFile(tun.keyFile, keyPEM, 0600)
+	ioutil.WriteFile(tun.knownHosts, []byte(knownhosts.Line([]string{tun.addr}, hostSigner.PublicKey())+"\n"), 0600)
+
+	client := &http.Client{Transport: tun.transport()}
+	get := func() {
+		resp, err := client.Get(exporter.URL)
+		if err != nil {
+			t.Fatalf("Failed to get metrics through tunnel - %s", err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "test_value 1\n" {
+			t.Fatalf("Unexpected metrics through tunnel %q", body)
+		}
+	}
+
+	get()
+	// broken connection to the jump host has to be re-established
+	jump.dropConns()
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	get()
+
+	if jump.accepted() != 2 {
+		t.Fatalf("Expected 2 connections to the jump host, got %d", jump.accepted())
+	}
+
+	// target refused by the jump host doesn't break the connection
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	if _, err := client.Get(closed.URL); err == nil {
+		t.Fatalf("Get of closed target through tunnel should fail")
+	}
+	get()
+	if jump.accepted() != 2 {
+		t.Fatalf("Connection to the jump host should be kept when target is refused, got %d connections", jump.accepted())
+	}
+}
+
+// SSH server forwarding direct-tcpip channels
+//
+type testJumpHost struct {
+	ln    net.Listener
+	mtx   sync.Mutex
+	conns []net.Conn
+	count int
+}
+
+func newTestJumpHost(t *testing.T, hostSigner ssh.Signer, userKey ssh.PublicKey) *testJumpHost {
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(userKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key of %s", c.User())
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen - %s", err.Error())
+	}
+	j := &testJumpHost{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			j.mtx.Lock()
+			j.conns = append(j.conns, conn)
+			j.count++
+			j.mtx.Unlock()
+			go j.serve(conn, cfg)
+		}
+	}()
+	return j
+}
+
+func (j *testJumpHost) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		var dst struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if nc.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nc.ExtraData(), &dst) != nil {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(dst.Host, fmt.Sprint(dst.Port)))
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			io.Copy(ch, target)
+			ch.Close()
+		}()
+		go func() {
+			io.Copy(target, ch)
+			target.Close()
+		}()
+	}
+}
+
+func (j *testJumpHost) dropConns() {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	for _, conn := range j.conns {
+		conn.Close()
+	}
+	j.conns = nil
+}
+
+func (j *testJumpHost) accepted() int {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.count
+}
+
+func (j *testJumpHost) close() {
+	j.ln.Close()
+	j.dropConns()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// runtime state of a resource persisted across restarts
+//
+type resourceState struct {
+	LastScrape   time.Time     `json:"last_scrape"`
+	LastPush     time.Time     `json:"last_push"`
+	Failures     int           `json:"failures"`
+	ScrapeFailed bool          `json:"scrape_failed"`
+	PushedDsts   []string      `json:"pushed_destinations,omitempty"`
+	PushedGroups []*groupState `json:"pushed_groups,omitempty"`
+}
+
+// group pushed with value of the grouping label
+//
+type groupState struct {
+	Dst   string `json:"destination"`
+	Value string `json:"value"`
+}
+
+// runtime state of all resources
+//
+type pusherState struct {
+	Resources map[string]*resourceState `json:"resources"`
+}
+
+// loads state from a state file, missing file results
+// in empty state
+//
+func loadState(path string) (*pusherState, error) {
+	st := &pusherState{Resources: make(map[string]*resourceState)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	if st.Resources == nil {
+		st.Resources = make(map[string]*resourceState)
+	}
+	return st, nil
+}
+
+// writes state into a state file, the file is replaced
+// atomically
+//
+func (st *pusherState) save(path string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// collects state of all resources
+//
+func (rs *resources) state() *pusherState {
+	st := &pusherState{Resources: make(map[string]*resourceState)}
+	for name, r := range rs.rs {
+		st.Resources[name] = r.state()
+	}
+	return st
+}
+
+// restores state of resources, state of resources which are
+// no longer configured is ignored
+//
+func (rs *resources) restoreState(st *pusherState) {
+	for name, r := range rs.rs {
+		if rst, ok := st.Resources[name]; ok {
+			r.restoreState(rst)
+		}
+	}
+}
+
+func (r *resource) state() *resourceState {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	rst := &resourceState{
+		LastScrape:   r.lastScrape,
+		LastPush:     r.lastPush,
+		Failures:     r.failures,
+		ScrapeFailed: r.scrapeFailed,
+		PushedDsts:   make([]string, 0, len(r.pushedDsts)),
+	}
+	for g := range r.pushedDsts {
+		if g.value == "" {
+			rst.PushedDsts = append(rst.PushedDsts, g.dst)
+			continue
+		}
+		rst.PushedGroups = append(rst.PushedGroups, &groupState{Dst: g.dst, Value: g.value})
+	}
+	sort.Strings(rst.PushedDsts)
+	sort.Slice(rst.PushedGroups, func(i, j int) bool {
+		if rst.PushedGroups[i].Dst != rst.PushedGroups[j].Dst {
+			return rst.PushedGroups[i].Dst < rst.PushedGroups[j].Dst
+		}
+		return rst.PushedGroups[i].Value < rst.PushedGroups[j].Value
+	})
+	return rst
+}
+
+// restores state of a resource, the last scrape time is kept
+// zero as the scraped metrics aren't persisted and the resource
+// has to be scraped again
+//
+func (r *resource) restoreState(rst *resourceState) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.lastPush = rst.LastPush
+	r.failures = rst.Failures
+	r.scrapeFailed = rst.ScrapeFailed
+	for _, dst := range rst.PushedDsts {
+		r.pushedDsts[pushGroup{dst: dst}] = true
+	}
+	for _, g := range rst.PushedGroups {
+		r.pushedDsts[pushGroup{dst: g.Dst, value: g.Value}] = true
+	}
+}
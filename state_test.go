@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher-state")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	c, _ := parseConfig(cfgTest)
+	grm, _ := newRouteMap("test/routes", "test")
+
+	t.Run("missing", func(t *testing.T) {
+		st, err := loadState(path)
+		if err != nil {
+			t.Fatalf("Missing state file should result in empty state - %s", err.Error())
+		}
+		if len(st.Resources) != 0 {
+			t.Fatalf("Missing state file should result in empty state, got %d resources", len(st.Resources))
+		}
+	})
+
+	now := time.Now().Truncate(time.Second)
+	t.Run("save", func(t *testing.T) {
+		rs, _ := createResources(c, grm)
+		defer rs.ticker.Stop()
+		r := rs.rs["resource1"]
+		r.lastPush = now
+		r.failures = 3
+		r.scrapeFailed = true
+		r.pushedDsts[pushGroup{dst: "test1"}] = true
+		if err := rs.state().save(path); err != nil {
+			t.Fatalf("Failed to save state - %s", err.Error())
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		st, err := loadState(path)
+		if err != nil {
+			t.Fatalf("Failed to load state - %s", err.Error())
+		}
+		rs, _ := createResources(c, grm)
+		defer rs.ticker.Stop()
+		rs.restoreState(st)
+		r := rs.rs["resource1"]
+		if !r.lastPush.Equal(now) || r.failures != 3 || !r.scrapeFailed || !r.pushedDsts[pushGroup{dst: "test1"}] {
+			t.Fatalf("Restored state doesn't match the saved one - %+v", st.Resources["resource1"])
+		}
+		if !rs.rs["resource2"].lastPush.IsZero() {
+			t.Fatalf("State of resource2 should be empty")
+		}
+	})
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// transformation of scraped metrics applied before
+// the metrics are inverse-multiplexed and pushed
+//
+type transform struct {
+	prefix    string        // prepended to every metric name
+	rename    []*renameRule // metric renaming rules
+	drop      []*selector   // selectors of dropped series
+	synthType string        // type of metrics without TYPE line
+	dropQuant bool          // drop quantiles of summaries
+	keepLe    []float64     // kept histogram buckets, all when empty
+}
+
+// metric renaming rule, either exact name or regular
+// expression is matched
+//
+type renameRule struct {
+	from string
+	re   *regexp.Regexp
+	to   string
+}
+
+// reference to capture group in rename target
+//
+var renameGroupRef = regexp.MustCompile(`\$(\w+|\{\w+\})`)
+
+// creates transform from resource config
+//
+func newTransform(rc *resourceConfig) *transform {
+	return &transform{
+		prefix:    rc.metricPrefix,
+		rename:    rc.rename,
+		drop:      rc.dropSeries,
+		synthType: rc.synthesizeType,
+		dropQuant: rc.dropQuantiles,
+		keepLe:    rc.keepBuckets,
+	}
+}
+
+// checks whether the transform would leave metrics untouched,
+// so the payload doesn't have to be parsed at all
+//
+func (t *transform) isNoop() bool {
+	return t.prefix == "" && len(t.rename) == 0 && len(t.drop) == 0 &&
+		t.synthType == "" && !t.dropQuant && len(t.keepLe) == 0
+}
+
+// parses metrics payload, transforms each metric family and
+// encodes them back into text format sorted by name
+//
+func (t *transform) apply(data []byte) ([]byte, error) {
+	if t.isNoop() {
+		return data, nil
+	}
+
+	var typed map[string]bool
+	if t.synthType != "" {
+		data, typed = normalizeMetadata(data)
+	}
+
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// renamed families may collide, merge them by their new name
+	byName := make(map[string]*dto.MetricFamily, len(mfs))
+	families := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		if t.synthType == "gauge" && !typed[mf.GetName()] {
+			untypedToGauge(mf)
+		}
+		if !t.applyFamily(mf) {
+			continue
+		}
+		if prev, ok := byName[mf.GetName()]; ok {
+			if prev.GetType() != mf.GetType() {
+				return nil, fmt.Errorf("renamed metrics collide in %s with different types", mf.GetName())
+			}
+			prev.Metric = append(prev.Metric, mf.Metric...)
+			continue
+		}
+		byName[mf.GetName()] = mf
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+
+	return encodeFamilies(families)
+}
+
+// drops repeated HELP and TYPE lines of the same metric, so
+// the payload can be parsed, the first line wins and conflicting
+// types are logged, returns names of the metrics with TYPE line
+//
+// Metrics without TYPE line are parsed as untyped and their
+// TYPE line is synthesized when the payload is encoded back.
+//
+func normalizeMetadata(data []byte) ([]byte, map[string]bool) {
+	types := make(map[string]string)
+	helps := make(map[string]bool)
+	out := make([]byte, 0, len(data))
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) < 3 || fields[0] != "#" {
+			out = append(out, line...)
+			continue
+		}
+		name := fields[2]
+		switch fields[1] {
+		case "HELP":
+			if helps[name] {
+				continue
+			}
+			helps[name] = true
+		case "TYPE":
+			typ := strings.Join(fields[3:], " ")
+			if prev, ok := types[name]; ok {
+				if prev != typ {
+					logger.Warnf("Conflicting TYPE lines of metric %s, keeping %s instead of %s", name, prev, typ)
+				}
+				continue
+			}
+			types[name] = typ
+		}
+		out = append(out, line...)
+	}
+
+	typed := make(map[string]bool, len(types))
+	for name := range types {
+		typed[name] = true
+	}
+	return out, typed
+}
+
+// turns untyped metric family into gauge
+//
+func untypedToGauge(mf *dto.MetricFamily) {
+	if mf.GetType() != dto.MetricType_UNTYPED {
+		return
+	}
+	typ := dto.MetricType_GAUGE
+	mf.Type = &typ
+	for _, m := range mf.Metric {
+		if m.Untyped != nil {
+			m.Gauge = &dto.Gauge{Value: m.Untyped.Value}
+			m.Untyped = nil
+		}
+	}
+}
+
+// encodes metric families into text format
+//
+func encodeFamilies(families []*dto.MetricFamily) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// partitions metrics payload by value of given label, series
+// without the label are kept under empty value
+//
+func partitionMetrics(data []byte, label string) (map[string][]byte, error) {
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make(map[string][]*dto.MetricFamily)
+	for _, mf := range mfs {
+		byValue := make(map[string]*dto.MetricFamily)
+		for _, m := range mf.Metric {
+			value := labelValue(mf.GetName(), m, label)
+			pmf, ok := byValue[value]
+			if !ok {
+				pmf = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				byValue[value] = pmf
+				partitions[value] = append(partitions[value], pmf)
+			}
+			pmf.Metric = append(pmf.Metric, m)
+		}
+	}
+
+	parts := make(map[string][]byte, len(partitions))
+	for value, families := range partitions {
+		sort.Slice(families, func(i, j int) bool {
+			return families[i].GetName() < families[j].GetName()
+		})
+		if parts[value], err = encodeFamilies(families); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// truncates metrics payload to given number of series, returns
+// the truncated payload and number of series in the original one
+//
+// Families are kept in the order of their names and series in
+// the order of their labels, so the same series are kept every
+// time. Summaries and histograms are counted with all their
+// series and kept either whole or not at all.
+//
+func truncateSeries(data []byte, limit int) ([]byte, int, error) {
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+
+	total := 0
+	kept := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		sort.Slice(mf.Metric, func(i, j int) bool {
+			return labelsString(mf.Metric[i]) < labelsString(mf.Metric[j])
+		})
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			n := seriesCount(m)
+			if total+n <= limit {
+				metrics = append(metrics, m)
+			}
+			total += n
+		}
+		mf.Metric = metrics
+		if len(mf.Metric) > 0 {
+			kept = append(kept, mf)
+		}
+	}
+
+	out, err := encodeFamilies(kept)
+	return out, total, err
+}
+
+// number of series the metric is exposed as
+//
+func seriesCount(m *dto.Metric) int {
+	switch {
+	case m.Summary != nil:
+		return len(m.Summary.Quantile) + 2
+	case m.Histogram != nil:
+		n := len(m.Histogram.Bucket) + 2
+		if len(m.Histogram.Bucket) == 0 || !math.IsInf(m.Histogram.Bucket[len(m.Histogram.Bucket)-1].GetUpperBound(), 1) {
+			n++ // +Inf bucket is added when encoding
+		}
+		return n
+	default:
+		return 1
+	}
+}
+
+// labels of the metric as a sortable string
+//
+func labelsString(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.Label))
+	for _, lp := range m.Label {
+		pairs = append(pairs, lp.GetName()+"="+lp.GetValue())
+	}
+	return strings.Join(pairs, ",")
+}
+
+// sets values of all the series in metrics payload to zero,
+// keeping their names and labels
+//
+func zeroMetrics(data []byte) ([]byte, error) {
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var zero float64
+	var zeroCount uint64
+	families := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			switch {
+			case m.Counter != nil:
+				m.Counter.Value = &zero
+			case m.Gauge != nil:
+				m.Gauge.Value = &zero
+			case m.Untyped != nil:
+				m.Untyped.Value = &zero
+			case m.Summary != nil:
+				m.Summary.SampleSum = &zero
+				m.Summary.SampleCount = &zeroCount
+				for _, q := range m.Summary.Quantile {
+					q.Value = &zero
+				}
+			case m.Histogram != nil:
+				m.Histogram.SampleSum = &zero
+				m.Histogram.SampleCount = &zeroCount
+				for _, b := range m.Histogram.Bucket {
+					b.CumulativeCount = &zeroCount
+				}
+			}
+		}
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+
+	return encodeFamilies(families)
+}
+
+// transforms single metric family in place, returns false
+// if the whole family was dropped
+//
+func (t *transform) applyFamily(mf *dto.MetricFamily) bool {
+	if len(t.drop) > 0 {
+		kept := mf.Metric[:0]
+	series:
+		for _, m := range mf.Metric {
+			for _, sel := range t.drop {
+				if sel.matches(mf.GetName(), m) {
+					continue series
+				}
+			}
+			kept = append(kept, m)
+		}
+		mf.Metric = kept
+		if len(mf.Metric) == 0 {
+			return false
+		}
+	}
+
+	for _, m := range mf.Metric {
+		if t.dropQuant && m.Summary != nil {
+			m.Summary.Quantile = nil
+		}
+		if len(t.keepLe) > 0 && m.Histogram != nil {
+			m.Histogram.Bucket = t.keptBuckets(m.Histogram.Bucket)
+		}
+	}
+
+	name := mf.GetName()
+	for _, rule := range t.rename {
+		if to, ok := rule.apply(name); ok {
+			name = to
+			break
+		}
+	}
+	name = t.prefix + name
+	mf.Name = &name
+	return true
+}
+
+// filters histogram buckets by their upper bounds, the `+Inf`
+// bucket is always kept
+//
+func (t *transform) keptBuckets(buckets []*dto.Bucket) []*dto.Bucket {
+	kept := buckets[:0]
+	for _, b := range buckets {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			kept = append(kept, b)
+			continue
+		}
+		for _, le := range t.keepLe {
+			if b.GetUpperBound() == le {
+				kept = append(kept, b)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// creates renaming rules from `[<resource>.rename]` table
+//
+// Keys starting with `~` are regular expressions matched against
+// the whole metric name, their replacements can refer to capture
+// groups (e.g. `$1`). Exact names take precedence, regular
+// expressions are tried in lexical order.
+//
+func newRenameRules(table map[string]interface{}) ([]*renameRule, error) {
+	exact := make([]*renameRule, 0)
+	regex := make([]*renameRule, 0)
+	for from, val := range table {
+		to, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("rename target of '%s' is not a string", from)
+		}
+		// capture groups are parts of valid metric names
+		if !model.IsValidMetricName(model.LabelValue(renameGroupRef.ReplaceAllString(to, "_"))) {
+			return nil, fmt.Errorf("rename target '%s' of '%s' isn't a valid metric name", to, from)
+		}
+		if !strings.HasPrefix(from, "~") {
+			exact = append(exact, &renameRule{from: from, to: to})
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(from, "~") + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid rename expression '%s' - %s", from, err.Error())
+		}
+		regex = append(regex, &renameRule{from: from, re: re, to: to})
+	}
+	sort.Slice(regex, func(i, j int) bool {
+		return regex[i].from < regex[j].from
+	})
+	return append(exact, regex...), nil
+}
+
+// renames metric name if the rule matches it
+//
+func (r *renameRule) apply(name string) (string, bool) {
+	if r.re == nil {
+		return r.to, name == r.from
+	}
+	if !r.re.MatchString(name) {
+		return name, false
+	}
+	return r.re.ReplaceAllString(name, r.to), true
+}
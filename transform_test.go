@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestTransform(t *testing.T) {
+	t.Run("noop", func(t *testing.T) {
+		out, err := newTransform(&resourceConfig{}).apply(mbTest)
+		if err != nil {
+			t.Fatalf("Failed to apply transform - %s", err.Error())
+		}
+		if !bytes.Equal(out, mbTest) {
+			t.Fatalf("Transform without options should leave metrics untouched")
+		}
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		out, err := newTransform(&resourceConfig{metricPrefix: "acme_"}).apply(mbTest)
+		if err != nil {
+			t.Fatalf("Failed to apply transform - %s", err.Error())
+		}
+		scn := bufio.NewScanner(bytes.NewBuffer(out))
+		for scn.Scan() {
+			line := scn.Text()
+			name := line
+			if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+				name = line[7:]
+			}
+			if !strings.HasPrefix(name, "acme_") {
+				t.Fatalf("Line `%s` is missing the metric prefix", line)
+			}
+		}
+	})
+}
+
+func TestRenameRules(t *testing.T) {
+	rules, err := newRenameRules(map[string]interface{}{
+		"go_goroutines":     "goroutines",
+		"~go_memstats_(.*)": "memory_$1",
+		"~go_gc_.*":         "go_gc",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rename rules - %s", err.Error())
+	}
+	tr := &transform{rename: rules}
+
+	renameCases := map[string]string{
+		"go_goroutines":            "goroutines",
+		"go_memstats_alloc_bytes":  "memory_alloc_bytes",
+		"go_gc_duration_seconds":   "go_gc",
+		"node_exporter_build_info": "node_exporter_build_info",
+	}
+	for from, to := range renameCases {
+		name := from
+		mf := &dto.MetricFamily{Name: &name}
+		tr.applyFamily(mf)
+		if mf.GetName() != to {
+			t.Fatalf("Metric `%s` expected to be renamed to `%s`, got `%s`", from, to, mf.GetName())
+		}
+	}
+
+	if _, err := newRenameRules(map[string]interface{}{"~go_(": "x"}); err == nil {
+		t.Fatalf("Invalid regular expression should be rejected")
+	}
+	for _, to := range []string{"go routines", "", "memory-$1"} {
+		if _, err := newRenameRules(map[string]interface{}{"~go_(.*)": to}); err == nil {
+			t.Fatalf("Invalid rename target '%s' should be rejected", to)
+		}
+	}
+}
+
+func TestTransformDropSeries(t *testing.T) {
+	idle, _ := newSelector(`node_cpu{mode="idle"}`)
+	name, _ := newSelector(`go_goroutines`)
+	out, err := (&transform{drop: []*selector{idle, name}}).apply(mbTest)
+	if err != nil {
+		t.Fatalf("Failed to apply transform - %s", err.Error())
+	}
+	if bytes.Contains(out, []byte("go_goroutines")) {
+		t.Fatalf("Dropped metric go_goroutines found in transformed metrics")
+	}
+	if bytes.Contains(out, []byte(`mode="idle"`)) {
+		t.Fatalf("Dropped idle CPU series found in transformed metrics")
+	}
+	if !bytes.Contains(out, []byte(`node_cpu{cpu="cpu0",mode="user"}`)) {
+		t.Fatalf("Series not matching any selector should be kept")
+	}
+}
+
+func TestPartitionMetrics(t *testing.T) {
+	data := []byte(`# TYPE jobs_total counter
+jobs_total{worker_id="1"} 10
+jobs_total{worker_id="2"} 20
+# TYPE uptime_seconds gauge
+uptime_seconds 300
+`)
+	parts, err := partitionMetrics(data, "worker_id")
+	if err != nil {
+		t.Fatalf("Failed to partition metrics - %s", err.Error())
+	}
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 partitions, got %d", len(parts))
+	}
+
+	partCases := map[string]string{
+		"1": `jobs_total{worker_id="1"} 10`,
+		"2": `jobs_total{worker_id="2"} 20`,
+		"":  `uptime_seconds 300`,
+	}
+	for value, series := range partCases {
+		if !bytes.Contains(parts[value], []byte(series)) {
+			t.Fatalf("Partition `%s` is missing `%s`, got:\n%s", value, series, parts[value])
+		}
+		if value != "" && !bytes.Contains(parts[value], []byte("# TYPE jobs_total counter")) {
+			t.Fatalf("Partition `%s` is missing TYPE line, got:\n%s", value, parts[value])
+		}
+	}
+	if bytes.Contains(parts["1"], []byte(`worker_id="2"`)) {
+		t.Fatalf("Partition `1` contains series of another worker")
+	}
+}
+
+func TestTransformSynthesizeType(t *testing.T) {
+	data := []byte(`# HELP jobs_total Jobs done.
+# TYPE jobs_total counter
+# HELP jobs_total Jobs done.
+# TYPE jobs_total gauge
+jobs_total 10
+queue_length 3
+`)
+
+	typeCases := map[string]string{
+		"untyped": "# TYPE queue_length untyped",
+		"gauge":   "# TYPE queue_length gauge",
+	}
+	for typ, expect := range typeCases {
+		out, err := (&transform{synthType: typ}).apply(data)
+		if err != nil {
+			t.Fatalf("Failed to apply transform - %s", err.Error())
+		}
+		if !bytes.Contains(out, []byte(expect)) {
+			t.Fatalf("Expected `%s` in transformed metrics, got:\n%s", expect, out)
+		}
+		if !bytes.Contains(out, []byte("# TYPE jobs_total counter")) || bytes.Count(out, []byte("# HELP jobs_total")) != 1 {
+			t.Fatalf("Expected single HELP and the first TYPE of jobs_total, got:\n%s", out)
+		}
+	}
+}
+
+func TestTransformQuantilesBuckets(t *testing.T) {
+	data := []byte(`# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.2
+rpc_duration_seconds{quantile="0.99"} 0.9
+rpc_duration_seconds_sum 12
+rpc_duration_seconds_count 40
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 10
+request_duration_seconds_bucket{le="0.5"} 20
+request_duration_seconds_bucket{le="1"} 30
+request_duration_seconds_bucket{le="+Inf"} 40
+request_duration_seconds_sum 15
+request_duration_seconds_count 40
+`)
+	c, err := parseConfig(append(cfgTest, []byte(`
+[resource3]
+port = 9100
+drop_quantiles = true
+keep_buckets = ["0.1", "1"]
+`)...))
+	if err != nil {
+		t.Fatalf("Failed to parse config - %s", err.Error())
+	}
+
+	out, err := newTransform(c.resources["resource3"]).apply(data)
+	if err != nil {
+		t.Fatalf("Failed to apply transform - %s", err.Error())
+	}
+	for _, dropped := range []string{`quantile=`, `le="0.5"`} {
+		if bytes.Contains(out, []byte(dropped)) {
+			t.Fatalf("Series with `%s` should be dropped, got:\n%s", dropped, out)
+		}
+	}
+	for _, kept := range []string{`rpc_duration_seconds_count 40`, `le="0.1"`, `le="1"`, `le="+Inf"`, `request_duration_seconds_sum 15`} {
+		if !bytes.Contains(out, []byte(kept)) {
+			t.Fatalf("Series with `%s` should be kept, got:\n%s", kept, out)
+		}
+	}
+}
+
+func TestTruncateSeries(t *testing.T) {
+	data := []byte(`# TYPE b_total counter
+b_total{id="2"} 2
+b_total{id="1"} 1
+# TYPE a_seconds histogram
+a_seconds_bucket{le="1"} 1
+a_seconds_bucket{le="+Inf"} 2
+a_seconds_sum 3
+a_seconds_count 2
+`)
+	out, total, err := truncateSeries(data, 5)
+	if err != nil {
+		t.Fatalf("Failed to truncate series - %s", err.Error())
+	}
+	if total != 6 {
+		t.Fatalf("Expected 6 series in total, got %d", total)
+	}
+	if !bytes.Contains(out, []byte("a_seconds_count 2")) || !bytes.Contains(out, []byte(`b_total{id="1"} 1`)) || bytes.Contains(out, []byte(`id="2"`)) {
+		t.Fatalf("Expected the histogram and the first counter series to be kept, got:\n%s", out)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// creates handler of the internal listener, `POST /-/reload`
+// calls given reload function and responds with its error
+//
+func newWebHandler(reload func() error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(self.render())
+	})
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err.Error()), http.StatusInternalServerError)
+		}
+	})
+	return mux
+}
+
+// starts internal listener in background, failure to listen
+// is fatal
+//
+func startWebListener(addr string, reload func() error) {
+	go func() {
+		logger.Infof("Listening on %s", addr)
+		if err := http.ListenAndServe(addr, newWebHandler(reload)); err != nil {
+			logger.Fatalf("Failed to listen on %s - %s", addr, err.Error())
+		}
+	}()
+}
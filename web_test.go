@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebReload(t *testing.T) {
+	var reloadErr error
+	reloads := 0
+	srv := httptest.NewServer(newWebHandler(func() error {
+		reloads++
+		return reloadErr
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/-/reload")
+	if err != nil {
+		t.Fatalf("Failed to request reload - %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || reloads != 0 {
+		t.Fatalf("Reload should require POST, got status %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(srv.URL+"/-/reload", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to request reload - %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || reloads != 1 {
+		t.Fatalf("Expected successful reload, got status %d", resp.StatusCode)
+	}
+
+	reloadErr = errors.New("invalid on_scrape_failure 'never'")
+	resp, err = http.Post(srv.URL+"/-/reload", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to request reload - %s", err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), "invalid on_scrape_failure") {
+		t.Fatalf("Expected failed reload with the error, got status %d and body %s", resp.StatusCode, body)
+	}
+}